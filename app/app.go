@@ -10,19 +10,45 @@ import (
 	"github.com/bepass-org/wireguard-go/wiresocks"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func RunWarp(psiphonEnabled, gool, scan, verbose bool, country, bindAddress, endpoint, license string, ctx context.Context) error {
+// RunWarp starts the tunnels the flags ask for and serves them on
+// bindAddress. psiphon, when enabled, runs over the innermost warp tunnel,
+// that is primary warp, warp in warp with gool or the peer of configPath,
+// or over no tunnel at all with direct.
+func RunWarp(psiphonEnabled, gool, direct, scan, verbose bool, psiphonOpts psiphon.Options, bindAddress, endpoint, license, configPath, upstreamProxy string, ctx context.Context) error {
 	// check if user input is not correct
-	if (psiphonEnabled && gool) || (!psiphonEnabled && country != "") {
+	if (!psiphonEnabled && (len(psiphonOpts.EgressRegions) > 0 || psiphonOpts.AutoRegion || direct)) ||
+		(direct && (gool || scan || configPath != "")) {
 		log.Println("Wrong combination of flags!")
 		flag.Usage()
 		return errors.New("wrong command")
 	}
 
+	var upstream *wiresocks.UpstreamConfig
+	if upstreamProxy != "" {
+		var err error
+		if upstream, err = wiresocks.ParseUpstream(upstreamProxy); err != nil {
+			return err
+		}
+	}
+
+	// the config path is relative to where we were started, not 'stuff'
+	primaryConfPath := "./primary/wgcf-profile.ini"
+	if configPath != "" {
+		var err error
+		primaryConfPath, err = filepath.Abs(configPath)
+		if err != nil {
+			return err
+		}
+	}
+
 	//create necessary file structures
 	if err := makeDirs(); err != nil {
 		return err
@@ -41,9 +67,12 @@ func RunWarp(psiphonEnabled, gool, scan, verbose bool, country, bindAddress, end
 		}
 	}()
 
-	//create identities
-	if err := createPrimaryAndSecondaryIdentities(license); err != nil {
-		return err
+	// a generic wireguard config needs no warp identity unless a warp hop or the scanner is used
+	if !direct && (configPath == "" || gool || scan) {
+		//create identities
+		if err := createPrimaryAndSecondaryIdentities(license); err != nil {
+			return err
+		}
 	}
 
 	//Decide Working Scenario
@@ -51,135 +80,146 @@ func RunWarp(psiphonEnabled, gool, scan, verbose bool, country, bindAddress, end
 
 	if scan {
 		var err error
-		endpoints, err = wiresocks.RunScan(&ctx)
+		endpoints, err = scanEndpoints(ctx)
 		if err != nil {
 			return err
 		}
-		log.Println("Cooling down please wait 5 seconds...")
-		time.Sleep(5 * time.Second)
 	}
 
-	if !psiphonEnabled && !gool {
-		// just run primary warp on bindAddress
-		_, _, err := runWarp(bindAddress, endpoints, "./primary/wgcf-profile.ini", verbose, true, ctx, true)
-		return err
-	} else if psiphonEnabled && !gool {
-		// run primary warp on a random tcp port and run psiphon on bind address
-		return runWarpWithPsiphon(bindAddress, endpoints, country, verbose, ctx)
-	} else if !psiphonEnabled && gool {
+	// the socks5 proxy is served by psiphon when it is enabled
+	startProxy := !psiphonEnabled
+	var tnet *wiresocks.VirtualTun
+	var err error
+	switch {
+	case direct:
+		// psiphon connects by itself
+	case gool:
 		// run warp in warp
-		return runWarpInWarp(bindAddress, endpoints, verbose, ctx)
+		tnet, err = runWarpInWarp(bindAddress, endpoints, primaryConfPath, upstream, verbose, startProxy, ctx)
+	default:
+		// run primary warp, on bindAddress unless psiphon runs over it
+		tnet, err = runWarp(bindAddress, endpoints, primaryConfPath, nil, upstream, verbose, startProxy, ctx, startProxy)
+		if err == nil && scan {
+			// keep the scanned endpoints around to move to when the first degrades
+			opts := wiresocks.DefaultMonitorOptions()
+			opts.Alternates = endpoints[1:]
+			go tnet.MonitorEndpoint(opts)
+		}
+	}
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("unknown error, it seems core related issue")
+	if psiphonEnabled {
+		return runPsiphon(bindAddress, tnet, upstream, psiphonOpts, ctx)
+	}
+	return nil
 }
 
-func runWarp(bindAddress string, endpoints []string, confPath string, verbose, startProxy bool, ctx context.Context, showServing bool) (*wiresocks.VirtualTun, int, error) {
+// runWarp starts the tunnel of confPath through hops and the hops of the
+// config, reaching the first of them through upstream when it is set, and
+// serves its socks5 proxy on bindAddress when startProxy is set
+func runWarp(bindAddress string, endpoints []string, confPath string, hops []*wiresocks.DeviceConfig, upstream *wiresocks.UpstreamConfig, verbose, startProxy bool, ctx context.Context, showServing bool) (*wiresocks.VirtualTun, error) {
 	conf, err := wiresocks.ParseConfig(confPath, endpoints[0])
 	if err != nil {
 		log.Println(err)
-		return nil, 0, err
+		return nil, err
+	}
+	conf.Hops = append(hops, conf.Hops...)
+	if upstream != nil {
+		conf.Upstream = upstream
 	}
 
-	tnet, err := wiresocks.StartWireguard(conf.Device, verbose, ctx)
+	tnet, err := wiresocks.StartChain(conf, verbose, ctx)
 	if err != nil {
 		log.Println(err)
-		return nil, 0, err
+		return nil, err
 	}
 
 	if startProxy {
 		tnet.StartProxy(bindAddress)
 	}
 
+	// spawn the forwards declared next to [Interface] and [Peer]
+	for _, spawner := range conf.Routines {
+		go spawner.SpawnRoutine(tnet)
+	}
+
+	// apply changes of the config file without dropping the tunnel, the
+	// working directory being restored once RunWarp returns
+	if abs, err := filepath.Abs(confPath); err == nil {
+		confPath = abs
+	}
+	go watchConfig(tnet, confPath, endpoints[0], ctx)
+
 	if showServing {
 		log.Printf("Serving on %s\n", bindAddress)
 	}
 
-	return tnet, conf.Device.MTU, nil
+	return tnet, nil
 }
 
-func runWarpWithPsiphon(bindAddress string, endpoints []string, country string, verbose bool, ctx context.Context) error {
-	// make a random bind address for warp
-	warpBindAddress, err := findFreePort("tcp")
+// runPsiphon runs psiphon with opts on bindAddress, dialing its servers
+// straight from the netstack of tnet, or directly through the socks5 proxy
+// of upstream when there is no tunnel
+func runPsiphon(bindAddress string, tnet *wiresocks.VirtualTun, upstream *wiresocks.UpstreamConfig, opts psiphon.Options, ctx context.Context) error {
+	host, port, err := net.SplitHostPort(bindAddress)
 	if err != nil {
-		log.Println("There are no free tcp ports on Device!")
 		return err
 	}
-
-	_, _, err = runWarp(warpBindAddress, endpoints, "./primary/wgcf-profile.ini", verbose, true, ctx, false)
-	if err != nil {
-		return err
+	if opts.LocalSocksProxyPort, err = strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid bind port %q", port)
 	}
-
-	// run psiphon
-	err = psiphon.RunPsiphon(warpBindAddress, bindAddress, country, ctx)
+	if opts.ListenInterface == "" && !strings.HasPrefix(host, "127.0.0") {
+		opts.ListenInterface = "any"
+	}
+	switch {
+	case tnet != nil:
+		opts.UpstreamDialer = tnet.Tnet.DialContext
+	case upstream != nil && upstream.Relay != "":
+		return errors.New("psiphon cannot connect through a relay without a warp tunnel")
+	case upstream != nil:
+		u := url.URL{Scheme: "socks5", Host: upstream.Socks5}
+		if upstream.Username != "" {
+			u.User = url.UserPassword(upstream.Username, upstream.Password)
+		}
+		opts.UpstreamProxyURL = u.String()
+	}
+	tunnel, err := psiphon.RunPsiphon(opts, ctx)
 	if err != nil {
 		log.Printf("unable to run psiphon %v", err)
 		return fmt.Errorf("unable to run psiphon %v", err)
 	}
+	setPsiphonTunnel(tunnel)
+	go func() {
+		<-tunnel.Done()
+		setPsiphonTunnel(nil)
+		if ctx.Err() == nil {
+			log.Println("psiphon stopped, it could not establish a tunnel again")
+		}
+	}()
 
-	log.Printf("Serving on %s\n", bindAddress)
+	if status := tunnel.Status(); status.Region != "" {
+		log.Printf("Serving on %s, psiphon exits in %s over %s\n", bindAddress, status.Region, status.Protocol)
+	} else {
+		log.Printf("Serving on %s\n", bindAddress)
+	}
 
 	return nil
 }
 
-func runWarpInWarp(bindAddress string, endpoints []string, verbose bool, ctx context.Context) error {
+// runWarpInWarp runs the tunnel of confPath over secondary warp, serving it
+// on bindAddress when startProxy is set
+func runWarpInWarp(bindAddress string, endpoints []string, confPath string, upstream *wiresocks.UpstreamConfig, verbose, startProxy bool, ctx context.Context) (*wiresocks.VirtualTun, error) {
 	// run secondary warp
-	vTUN, mtu, err := runWarp("", endpoints, "./secondary/wgcf-profile.ini", verbose, false, ctx, false)
-	if err != nil {
-		return err
-	}
-
-	// run virtual endpoint
-	virtualEndpointBindAddress, err := findFreePort("udp")
-	if err != nil {
-		log.Println("There are no free udp ports on Device!")
-		return err
-	}
-	addr := endpoints[1]
-	if addr == "notset" {
-		addr, _ = wiresocks.ResolveIPPAndPort("engage.cloudflareclient.com:2408")
-	}
-	err = wiresocks.NewVtunUDPForwarder(virtualEndpointBindAddress, addr, vTUN, mtu+100, ctx)
+	secondary, err := wiresocks.ParseConfig("./secondary/wgcf-profile.ini", endpoints[0])
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
-	// run primary warp
-	_, _, err = runWarp(bindAddress, []string{virtualEndpointBindAddress}, "./primary/wgcf-profile.ini", verbose, true, ctx, true)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func findFreePort(network string) (string, error) {
-	if network == "udp" {
-		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-		if err != nil {
-			return "", err
-		}
-
-		conn, err := net.ListenUDP("udp", addr)
-		if err != nil {
-			return "", err
-		}
-		defer conn.Close()
-
-		return conn.LocalAddr().(*net.UDPAddr).String(), nil
-	}
-	// Listen on TCP port 0, which tells the OS to pick a free port.
-	listener, err := net.Listen(network, "127.0.0.1:0")
-	if err != nil {
-		return "", err // Return error if unable to listen on a port
-	}
-	defer listener.Close() // Ensure the listener is closed when the function returns
-
-	// Get the port from the listener's address
-	addr := listener.Addr().String()
-
-	return addr, nil
+	// run primary warp over the netstack of the secondary
+	return runWarp(bindAddress, endpoints[1:], confPath, []*wiresocks.DeviceConfig{secondary.Device}, upstream, verbose, startProxy, ctx, startProxy)
 }
 
 func createPrimaryAndSecondaryIdentities(license string) error {
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bepass-org/wireguard-go/wiresocks"
+)
+
+// CheckConfig parses and validates the config file at path and reports every
+// problem found. When print is set the normalized wg-quick config is written
+// to stdout, which makes it easy to diff two configs.
+func CheckConfig(path string, print bool) error {
+	conf, err := wiresocks.ParseConfig(path, "notset")
+	if err != nil {
+		return fmt.Errorf("%s is invalid:\n%v", path, err)
+	}
+
+	if err := conf.Device.Validate(); err != nil {
+		return fmt.Errorf("%s is invalid:\n%v", path, err)
+	}
+	for i, hop := range conf.Hops {
+		if err := hop.Validate(); err != nil {
+			return fmt.Errorf("%s is invalid:\n[Hop #%d]: %v", path, i+1, err)
+		}
+	}
+
+	if print {
+		data, err := wiresocks.Marshal(conf.Device)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	fmt.Printf("%s is valid: %d peer(s), %d service(s), %d hop(s)\n", path, len(conf.Device.Peers), len(conf.Routines), len(conf.Hops))
+	return nil
+}
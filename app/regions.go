@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/psiphon"
+)
+
+// regionJSON is a region as PsiphonRegions writes it in json
+type regionJSON struct {
+	Region string `json:"region"`
+	// Reachable and LatencyMS are only written with -latency, LatencyMS
+	// only for a region which answered
+	Reachable *bool    `json:"reachable,omitempty"`
+	LatencyMS *float64 `json:"latency_ms,omitempty"`
+}
+
+// PsiphonRegions writes the egress regions psiphon has servers in to w as
+// text or json, fastest first with their latency when latency is set. The
+// data directory of opts is relative to 'stuff' as it is for -cfon.
+func PsiphonRegions(opts psiphon.Options, latency bool, format string, w io.Writer, ctx context.Context) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, expected text or json", format)
+	}
+
+	if err := makeDirs(); err != nil {
+		return err
+	}
+	if err := os.Chdir("stuff"); err != nil {
+		return fmt.Errorf("Error changing to 'stuff' directory: %v", err)
+	}
+	defer func() {
+		if err := os.Chdir(".."); err != nil {
+			log.Fatal("Error changing to 'main' directory:", err)
+		}
+	}()
+
+	regions, err := psiphon.DiscoverRegions(opts, ctx)
+	if err != nil {
+		return err
+	}
+	var latencies []psiphon.RegionLatency
+	if latency {
+		if latencies, err = psiphon.MeasureRegions(opts, regions, ctx); err != nil {
+			return err
+		}
+	} else {
+		for _, region := range regions {
+			latencies = append(latencies, psiphon.RegionLatency{Region: region})
+		}
+	}
+
+	return writeRegions(w, latencies, latency, format)
+}
+
+// writeRegions writes latencies as PsiphonRegions does, a zero latency
+// being that of a region none of whose servers answered
+func writeRegions(w io.Writer, latencies []psiphon.RegionLatency, latency bool, format string) error {
+	if format == "json" {
+		results := make([]regionJSON, len(latencies))
+		for i, l := range latencies {
+			results[i].Region = l.Region
+			if latency {
+				reachable := l.Latency != 0
+				results[i].Reachable = &reachable
+				if reachable {
+					ms := float64(l.Latency) / float64(time.Millisecond)
+					results[i].LatencyMS = &ms
+				}
+			}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	for _, l := range latencies {
+		var err error
+		switch {
+		case !latency:
+			_, err = fmt.Fprintln(w, l.Region)
+		case l.Latency == 0:
+			_, err = fmt.Fprintf(w, "%s\tunreachable\n", l.Region)
+		default:
+			_, err = fmt.Fprintf(w, "%s\t%s\n", l.Region, l.Latency.Round(time.Millisecond))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/psiphon"
+)
+
+func TestWriteRegions(t *testing.T) {
+	latencies := []psiphon.RegionLatency{
+		{Region: "DE", Latency: 120 * time.Millisecond},
+		{Region: "NL"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeRegions(&buf, latencies, true, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var measured []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &measured); err != nil {
+		t.Fatal(err)
+	}
+	if len(measured) != 2 || measured[0]["reachable"] != true || measured[0]["latency_ms"] != 120.0 {
+		t.Errorf("reachable region written as %v", measured)
+	}
+	// an unreachable region has no latency rather than the fastest one
+	if _, ok := measured[1]["latency_ms"]; ok || measured[1]["reachable"] != false {
+		t.Errorf("unreachable region written as %v", measured[1])
+	}
+
+	buf.Reset()
+	if err := writeRegions(&buf, latencies, false, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var listed []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed[0]) != 1 || listed[0]["region"] != "DE" {
+		t.Errorf("region without -latency written as %v", listed[0])
+	}
+
+	buf.Reset()
+	if err := writeRegions(&buf, latencies, true, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "DE\t120ms\nNL\tunreachable\n" {
+		t.Errorf("text written as %q", buf.String())
+	}
+}
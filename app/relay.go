@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/bepass-org/wireguard-go/wiresocks"
+)
+
+// RelayOptions configure the relay server carrying WireGuard over a stream
+// or HTTP requests
+type RelayOptions struct {
+	Listen    string // address to listen on
+	Transport string // tcp, tls, ws, wss, http or https
+	CertFile  string // certificate and key for tls, wss and https
+	KeyFile   string
+	Path      string // HTTP path of the ws, wss, http and https endpoint
+	Allow     string // comma separated prefixes clients may send to
+	Target    string // host:port, the only destination clients may send to when set
+	// MaxSessions is the number of http and https clients served at once
+	MaxSessions int
+}
+
+// RunRelay serves relay clients until ctx is done, forwarding their
+// datagrams over UDP to the WireGuard endpoints they name. Either Allow or
+// Target must be set so the relay is not open to any destination.
+func RunRelay(opts RelayOptions, ctx context.Context) error {
+	if opts.Allow == "" && opts.Target == "" {
+		return errors.New("the relay needs -target or -allow to limit the destinations of its clients")
+	}
+	server := &wiresocks.RelayServer{MaxHTTPSessions: opts.MaxSessions}
+	if opts.Allow != "" {
+		for _, s := range strings.Split(opts.Allow, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid -allow: %w", err)
+			}
+			server.Allow = append(server.Allow, prefix)
+		}
+	}
+	if opts.Target != "" {
+		addr, err := net.ResolveUDPAddr("udp", opts.Target)
+		if err != nil {
+			return fmt.Errorf("invalid -target: %w", err)
+		}
+		target := addr.AddrPort()
+		server.Target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+	}
+
+	var tlsConfig *tls.Config
+	if opts.Transport == "tls" || opts.Transport == "wss" || opts.Transport == "https" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	log.Printf("relay serving %s on %s", opts.Transport, listener.Addr())
+
+	mux := http.NewServeMux()
+	switch opts.Transport {
+	case "tcp", "tls":
+		return server.Serve(ctx, listener)
+	case "ws", "wss":
+		mux.Handle(opts.Path, server.WebSocketHandler())
+	case "http", "https":
+		mux.Handle(opts.Path, server.HTTPHandler())
+	default:
+		_ = listener.Close()
+		return fmt.Errorf("unsupported transport %q, expected tcp, tls, ws, wss, http or https", opts.Transport)
+	}
+
+	httpServer := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
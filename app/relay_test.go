@@ -0,0 +1,16 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunRelayOpen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := RunRelay(RelayOptions{Listen: "127.0.0.1:0", Transport: "tcp", Path: "/"}, ctx)
+	if err == nil || !strings.Contains(err.Error(), "-target or -allow") {
+		t.Errorf("relay without -target or -allow started: %v", err)
+	}
+}
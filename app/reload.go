@@ -0,0 +1,37 @@
+package app
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/wiresocks"
+)
+
+// watchConfig reloads the config file of tnet when it changes on disk or
+// when the process receives SIGHUP
+func watchConfig(tnet *wiresocks.VirtualTun, confPath, endpoint string, ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	trigger := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+				select {
+				case trigger <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	tnet.WatchConfig(ctx, confPath, endpoint, 2*time.Second, trigger)
+}
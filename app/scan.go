@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/wiresocks"
+)
+
+// scanCacheFile keeps the scan results in 'stuff' between runs
+const scanCacheFile = "scan-cache.json"
+
+// loadScanIdentity fills opts with the keys of the warp profile at path
+func loadScanIdentity(opts *wiresocks.ScanOptions, path string) error {
+	conf, err := wiresocks.ParseConfig(path, "notset")
+	if err != nil {
+		return err
+	}
+	opts.PrivateKey = conf.Device.SecretKey
+	opts.PublicKey = conf.Device.Peers[0].PublicKey
+	opts.PresharedKey = conf.Device.Peers[0].PreSharedKey
+	return nil
+}
+
+// scanEndpoints returns the usable endpoints, best first and at least two
+// for the primary and secondary warp, from the cache when it is fresh
+func scanEndpoints(ctx context.Context) ([]string, error) {
+	opts := wiresocks.DefaultScanOptions()
+	opts.CacheFile = scanCacheFile
+	if err := loadScanIdentity(&opts, "./primary/wgcf-profile.ini"); err != nil {
+		return nil, err
+	}
+
+	results, err := wiresocks.RunScan(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no usable endpoints found")
+	}
+	endpoints := make([]string, len(results))
+	for i, result := range results {
+		endpoints[i] = result.Endpoint
+	}
+	if len(endpoints) == 1 {
+		endpoints = append(endpoints, endpoints[0])
+	}
+	return endpoints, nil
+}
+
+// Scan scans for warp endpoints with opts and writes every measured endpoint,
+// best first, to w as json or csv. The results are merged into the cache used
+// by -scan, and the ports which passed on this network so far are logged.
+func Scan(opts wiresocks.ScanOptions, license, format string, w io.Writer, ctx context.Context) error {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown format %q, expected json or csv", format)
+	}
+
+	if err := makeDirs(); err != nil {
+		return err
+	}
+	if err := os.Chdir("stuff"); err != nil {
+		return fmt.Errorf("Error changing to 'stuff' directory: %v", err)
+	}
+	defer func() {
+		if err := os.Chdir(".."); err != nil {
+			log.Fatal("Error changing to 'main' directory:", err)
+		}
+	}()
+
+	if err := createPrimaryAndSecondaryIdentities(license); err != nil {
+		return err
+	}
+	if err := loadScanIdentity(&opts, "./primary/wgcf-profile.ini"); err != nil {
+		return err
+	}
+
+	if opts.Network == "" {
+		opts.Network = wiresocks.NetworkID()
+	}
+	opts.CacheFile = scanCacheFile
+	results, err := wiresocks.Scan(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := wiresocks.SaveScanCache(scanCacheFile, results); err != nil {
+		log.Printf("unable to write scan cache: %v", err)
+	}
+
+	// report which ports get through on this network, over every scan
+	cached, err := wiresocks.LoadScanCache(scanCacheFile)
+	if err != nil {
+		cached = results
+	}
+	stats := wiresocks.PortStats(cached, opts.Network)
+	ports := make([]int, 0, len(stats))
+	for port := range stats {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		stat := stats[port]
+		log.Printf("network %s port %d: %d/%d handshakes", opts.Network, port, stat.Passed, stat.Passed+stat.Failed)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"network", "endpoint", "rtt_ms", "loss", "samples", "measured_at"})
+	for _, result := range results {
+		_ = writer.Write([]string{
+			result.Network,
+			result.Endpoint,
+			strconv.FormatFloat(result.RTT, 'f', 3, 64),
+			strconv.FormatFloat(result.Loss, 'f', 2, 64),
+			strconv.Itoa(result.Samples),
+			result.MeasuredAt.Format(time.RFC3339),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bepass-org/wireguard-go/wiresocks"
+)
+
+// RunServer serves the peers of the config at configPath until ctx is done,
+// their connections leaving through the egress of its [Server] section: the
+// host, primary warp on endpoint or the tunnel of another config
+func RunServer(configPath, endpoint, license string, verbose bool, ctx context.Context) error {
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return err
+	}
+	conf, err := wiresocks.ParseConfig(configPath, endpoint)
+	if err != nil {
+		return err
+	}
+	serverConf := wiresocks.DefaultServerConfig()
+	if conf.Server != nil {
+		serverConf = *conf.Server
+	}
+
+	egress := wiresocks.HostEgress
+	if serverConf.Egress != wiresocks.EgressDirect {
+		tnet, err := startEgress(serverConf.Egress, endpoint, license, verbose, ctx)
+		if err != nil {
+			return fmt.Errorf("egress: %w", err)
+		}
+		egress = tnet.Tnet.DialContext
+	}
+
+	if _, err := wiresocks.StartServer(conf, egress, verbose, ctx); err != nil {
+		return err
+	}
+	log.Printf("Serving %d peers on port %d through %s egress", len(conf.Device.Peers), *conf.Device.ListenPort, serverConf.Egress)
+
+	<-ctx.Done()
+	return nil
+}
+
+// startEgress starts the tunnel the peers of a server leave through, primary
+// warp or the one of the config at path
+func startEgress(path, endpoint, license string, verbose bool, ctx context.Context) (*wiresocks.VirtualTun, error) {
+	if path != wiresocks.EgressWarp {
+		conf, err := wiresocks.ParseConfig(path, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return wiresocks.StartChain(conf, verbose, ctx)
+	}
+
+	if err := makeDirs(); err != nil {
+		return nil, err
+	}
+	if err := os.Chdir("stuff"); err != nil {
+		return nil, fmt.Errorf("Error changing to 'stuff' directory: %v\n", err)
+	}
+	defer func() {
+		if err := os.Chdir(".."); err != nil {
+			log.Fatal("Error changing to 'main' directory:", err)
+		}
+	}()
+	if err := createPrimaryAndSecondaryIdentities(license); err != nil {
+		return nil, err
+	}
+	conf, err := wiresocks.ParseConfig("./primary/wgcf-profile.ini", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return wiresocks.StartChain(conf, verbose, ctx)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/psiphon"
+)
+
+// Status is what RunWarp reports about the tunnels it started
+type Status struct {
+	// Psiphon is the health of the psiphon tunnel and the region it exits
+	// in, nil when psiphon is not running
+	Psiphon *psiphon.Status
+}
+
+var running struct {
+	mu      sync.Mutex
+	psiphon *psiphon.Tunnel
+}
+
+// setPsiphonTunnel records the psiphon tunnel reported by CurrentStatus
+func setPsiphonTunnel(tunnel *psiphon.Tunnel) {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+	running.psiphon = tunnel
+}
+
+// CurrentStatus returns the status of the tunnels which are running
+func CurrentStatus() Status {
+	running.mu.Lock()
+	tunnel := running.psiphon
+	running.mu.Unlock()
+
+	var status Status
+	if tunnel != nil {
+		select {
+		case <-tunnel.Done():
+		default:
+			s := tunnel.Status()
+			status.Psiphon = &s
+		}
+	}
+	return status
+}
+
+// String describes the status on a line
+func (s Status) String() string {
+	p := s.Psiphon
+	switch {
+	case p == nil:
+		return "psiphon is not running"
+	case p.Connected:
+		return fmt.Sprintf("psiphon exits in %s over %s with %d tunnels", p.Region, p.Protocol, p.Tunnels)
+	case p.LastUpstreamError != "":
+		return fmt.Sprintf("psiphon is reconnecting, upstream failed %s ago: %s",
+			time.Since(p.LastUpstreamErrorAt).Round(time.Second), p.LastUpstreamError)
+	case len(p.AvailableRegions) > 0:
+		return "psiphon is reconnecting, servers are in " + strings.Join(p.AvailableRegions, ",")
+	}
+	return "psiphon is reconnecting"
+}
+
+// WaitStopped waits up to timeout for psiphon to stop once the context of
+// RunWarp is done, so its datastore is closed before the process exits. It
+// reports whether psiphon stopped in time.
+func WaitStopped(timeout time.Duration) bool {
+	running.mu.Lock()
+	tunnel := running.psiphon
+	running.mu.Unlock()
+	if tunnel == nil {
+		return true
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		<-tunnel.Done()
+		// returns once the datastore is closed, whoever stops the tunnel
+		tunnel.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,22 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/bepass-org/wireguard-go/psiphon"
+)
+
+func TestStatusString(t *testing.T) {
+	for expected, status := range map[string]Status{
+		"psiphon is not running":                        {},
+		"psiphon exits in DE over OSSH with 1 tunnels":  {Psiphon: &psiphon.Status{Connected: true, Tunnels: 1, Region: "DE", Protocol: "OSSH"}},
+		"psiphon is reconnecting, servers are in DE,NL": {Psiphon: &psiphon.Status{AvailableRegions: []string{"DE", "NL"}}},
+	} {
+		if got := status.String(); got != expected {
+			t.Errorf("got %q, expected %q", got, expected)
+		}
+	}
+	if got := CurrentStatus().String(); got != "psiphon is not running" {
+		t.Errorf("status without psiphon: %q", got)
+	}
+}
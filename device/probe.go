@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// ProbeConfig describes the handshake made by Probe.
+type ProbeConfig struct {
+	PrivateKey   NoisePrivateKey
+	PublicKey    NoisePublicKey // of the peer
+	PresharedKey NoisePresharedKey
+	Endpoint     string // host:port of the peer
+
+	// Junk sends the random packets a Device sends ahead of its handshake
+	// initiations, so the probe looks the same to middleboxes.
+	Junk bool
+}
+
+// ProbeResult is the outcome of a successful Probe.
+type ProbeResult struct {
+	// RTT is the time between sending the handshake initiation and receiving
+	// a valid response.
+	RTT time.Duration
+	// Cookie is set when the peer was under load and answered the first
+	// initiation with a cookie reply.
+	Cookie bool
+}
+
+var errProbeCookie = errors.New("peer sent more than one cookie reply")
+
+// Probe performs a WireGuard handshake with the peer at cfg.Endpoint and
+// measures the time it takes to receive a valid handshake response. No
+// session is kept and nothing but the handshake is sent. The probe gives up
+// when ctx is done.
+func Probe(ctx context.Context, cfg ProbeConfig) (*ProbeResult, error) {
+	// a device and peer carrying just the state needed for the handshake
+	device := new(Device)
+	device.indexTable.Init()
+	device.staticIdentity.privateKey = cfg.PrivateKey
+	device.staticIdentity.publicKey = cfg.PrivateKey.publicKey()
+
+	peer := new(Peer)
+	peer.device = device
+	peer.cookieGenerator.Init(cfg.PublicKey)
+	peer.handshake.remoteStatic = cfg.PublicKey
+	peer.handshake.presharedKey = cfg.PresharedKey
+	peer.handshake.precomputedStaticStatic, _ = cfg.PrivateKey.sharedSecret(cfg.PublicKey)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// unblock the read below when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if cfg.Junk {
+		err = sendJunkPackets(func(packet []byte) error {
+			_, err := conn.Write(packet)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := new(ProbeResult)
+	sent, err := sendProbeInitiation(device, peer, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf [MessageHandshakeSize]byte
+	for {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		packet := buf[:n]
+		if len(packet) < 4 {
+			continue
+		}
+
+		switch binary.LittleEndian.Uint32(packet[:4]) {
+		case MessageResponseType:
+			if len(packet) != MessageResponseSize {
+				continue
+			}
+			var msg MessageResponse
+			if err := binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg); err != nil {
+				continue
+			}
+			if device.ConsumeMessageResponse(&msg) == nil {
+				continue
+			}
+			result.RTT = time.Since(sent)
+			return result, nil
+
+		case MessageCookieReplyType:
+			if len(packet) != MessageCookieReplySize {
+				continue
+			}
+			var reply MessageCookieReply
+			if err := binary.Read(bytes.NewReader(packet), binary.LittleEndian, &reply); err != nil {
+				continue
+			}
+			if !peer.cookieGenerator.ConsumeReply(&reply) {
+				continue
+			}
+			if result.Cookie {
+				return nil, errProbeCookie
+			}
+
+			// retry at once with the cookie instead of waiting like a Device
+			result.Cookie = true
+			if sent, err = sendProbeInitiation(device, peer, conn); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// sendProbeInitiation sends a fresh handshake initiation and returns when
+// it was sent.
+func sendProbeInitiation(device *Device, peer *Peer, conn net.Conn) (time.Time, error) {
+	msg, err := device.CreateMessageInitiation(peer)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var buf [MessageInitiationSize]byte
+	writer := bytes.NewBuffer(buf[:0])
+	binary.Write(writer, binary.LittleEndian, msg)
+	packet := writer.Bytes()
+	peer.cookieGenerator.AddMacs(packet)
+
+	sent := time.Now()
+	_, err = conn.Write(packet)
+	return sent, err
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+	"github.com/bepass-org/wireguard-go/tun/tuntest"
+)
+
+func TestProbe(t *testing.T) {
+	var clientKey, serverKey NoisePrivateKey
+	var psk NoisePresharedKey
+	for _, b := range [][]byte{clientKey[:], serverKey[:], psk[:]} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clientPub, serverPub := clientKey.publicKey(), serverKey.publicKey()
+
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, "server: "))
+	t.Cleanup(dev.Close)
+	err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(serverKey[:]),
+		"listen_port", "0",
+		"public_key", hex.EncodeToString(clientPub[:]),
+		"preshared_key", hex.EncodeToString(psk[:]),
+		"allowed_ip", "1.0.0.1/32",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ProbeConfig{
+		PrivateKey:   clientKey,
+		PublicKey:    serverPub,
+		PresharedKey: psk,
+		Endpoint:     fmt.Sprintf("127.0.0.1:%d", dev.net.port),
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := Probe(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.RTT <= 0 || result.Cookie {
+			t.Errorf("unexpected result %+v", result)
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		// a device under load answers initiations without a valid mac2 with a
+		// cookie reply
+		dev.rate.underLoadUntil.Store(time.Now().Add(time.Minute).UnixNano())
+		defer dev.rate.underLoadUntil.Store(0)
+		// initiations closer than this to the last one are dropped as a flood
+		time.Sleep(HandshakeInitationRate)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := Probe(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Cookie {
+			t.Errorf("expected a cookie reply, got %+v", result)
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		wrong := cfg
+		wrong.PresharedKey = NoisePresharedKey{}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if _, err := Probe(ctx, wrong); err != context.DeadlineExceeded {
+			t.Errorf("expected no response, got %v", err)
+		}
+	})
+}
@@ -8,19 +8,12 @@ package device
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"net"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
@@ -114,70 +107,29 @@ func randomInt(min, max int) int {
 	return int(nBig.Int64()) + min
 }
 
-func sendPacketAndGetResponse(serverAddr, packetHex string) (string, error) {
-	// Prepare the request
-	data := url.Values{}
-	data.Set("packet", packetHex) // The server expects 'packet' parameter
-	req, err := http.NewRequest("POST", serverAddr, strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", err
-	}
-
-	// Set common browser-like headers
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Go HTTP client)")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
-
-	// Create an HTTP client that handles HTTPS and redirects like a browser
-	jar, _ := cookiejar.New(nil)
-	client := &http.Client{
-		Jar: jar,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse // Handle redirects manually if needed
-		},
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // Skip SSL verification (not recommended for production)
-			},
-		},
-	}
-
-	// Send the request
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Read the response
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	return string(body), nil
-}
+// sendJunkPackets sends a few random packets ahead of a handshake initiation
+func sendJunkPackets(send func(packet []byte) error) error {
+	// Generate a random number of packets between 5 and 10
+	numPackets := randomInt(5, 10)
+	for i := 0; i < numPackets; i++ {
+		// Generate a random packet size between 10 and 40 bytes
+		packetSize := randomInt(10, 40)
+		randomPacket := make([]byte, packetSize)
+		_, err := rand.Read(randomPacket)
+		if err != nil {
+			return fmt.Errorf("error generating random packet: %v", err)
+		}
 
-func sendPacketToPeer(peerAddr, responseHex string) error {
-	// Decode the hex string to binary
-	packet, err := hex.DecodeString(responseHex)
-	if err != nil {
-		return fmt.Errorf("invalid hex string: %v", err)
-	}
+		// Send the random packet
+		err = send(randomPacket)
+		if err != nil {
+			return fmt.Errorf("error sending random packet: %v", err)
+		}
 
-	// Create a UDP connection to the peer
-	conn, err := net.Dial("udp", peerAddr)
-	if err != nil {
-		return fmt.Errorf("dial error: %v", err)
+		// Wait for a random duration between 200 and 500 milliseconds
+		time.Sleep(time.Duration(randomInt(200, 500)) * time.Millisecond)
 	}
-	defer conn.Close()
-
-	// Send the packet
-	_, err = conn.Write(packet)
-	return err
+	return nil
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
@@ -217,25 +169,11 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	// Generate a random number of packets between 5 and 10
-	numPackets := randomInt(5, 10)
-	for i := 0; i < numPackets; i++ {
-		// Generate a random packet size between 10 and 40 bytes
-		packetSize := randomInt(10, 40)
-		randomPacket := make([]byte, packetSize)
-		_, err := rand.Read(randomPacket)
-		if err != nil {
-			return fmt.Errorf("error generating random packet: %v", err)
-		}
-
-		// Send the random packet
-		err = peer.SendBuffers([][]byte{randomPacket})
-		if err != nil {
-			return fmt.Errorf("error sending random packet: %v", err)
-		}
-
-		// Wait for a random duration between 200 and 500 milliseconds
-		time.Sleep(time.Duration(randomInt(200, 500)) * time.Millisecond)
+	err = sendJunkPackets(func(packet []byte) error {
+		return peer.SendBuffers([][]byte{packet})
+	})
+	if err != nil {
+		return err
 	}
 
 	err = peer.SendBuffers([][]byte{packet})
@@ -3,44 +3,259 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/bepass-org/wireguard-go/app"
+	"github.com/bepass-org/wireguard-go/psiphon"
+	"github.com/bepass-org/wireguard-go/wiresocks"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// shutdownTimeout bounds the wait for the tunnels to stop once interrupted
+const shutdownTimeout = 10 * time.Second
+
 func usage() {
-	log.Println("Usage: wiresocks [-v] [-b addr:port] [-l license] <config file path>")
+	log.Println("Usage: wiresocks [-v] [-b addr:port] [-c config file path] [-e endpoint] [-k license] [-upstream socks5 proxy or relay URL]")
+	log.Println("       wiresocks relay [-listen addr:port] [-transport tcp|tls|ws|wss|http|https] -target host:port|-allow prefixes [-cert file -key file] [-path path]")
+	log.Println("       wiresocks check [-print] <config file path>")
+	log.Println("       wiresocks regions [-latency] [-format text|json] [-upstream socks5 URL] [-data-dir path]")
+	log.Println("       wiresocks serve -c <config file path> [-e endpoint] [-k license] [-v]")
+	log.Println("       wiresocks scan [-format json|csv] [-cidr ranges] [-ports ports] [-samples n] ...")
 	flag.PrintDefaults()
 }
 
+// commands are the subcommands that can be given instead of running the proxy
+var commands = map[string]func(args []string) error{
+	"check":   checkCommand,
+	"regions": regionsCommand,
+	"relay":   relayCommand,
+	"scan":    scanCommand,
+	"serve":   serveCommand,
+}
+
+func checkCommand(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	printConf := fs.Bool("print", false, "print the normalized wg-quick config")
+	fs.Usage = func() {
+		log.Println("Usage: wiresocks check [-print] <config file path>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return app.CheckConfig(fs.Arg(0), *printConf)
+}
+
+func relayCommand(args []string) error {
+	var opts app.RelayOptions
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	fs.StringVar(&opts.Listen, "listen", "0.0.0.0:8443", "address to accept relay clients on")
+	fs.StringVar(&opts.Transport, "transport", "tcp", "transport the clients use, tcp, tls, ws, wss, http or https")
+	fs.StringVar(&opts.CertFile, "cert", "", "certificate file for tls, wss and https")
+	fs.StringVar(&opts.KeyFile, "key", "", "private key file for tls, wss and https")
+	fs.StringVar(&opts.Path, "path", "/", "HTTP path of the ws, wss, http and https endpoint")
+	fs.StringVar(&opts.Target, "target", "", "host:port of the only endpoint clients may reach")
+	fs.StringVar(&opts.Allow, "allow", "", "comma separated prefixes clients may reach, private and loopback ones only when listed on their own")
+	fs.IntVar(&opts.MaxSessions, "max-sessions", wiresocks.DefaultMaxHTTPSessions, "http and https clients served at once")
+	fs.Usage = func() {
+		log.Println("Usage: wiresocks relay [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return app.RunRelay(opts, ctx)
+}
+
+func regionsCommand(args []string) error {
+	opts := psiphon.DefaultOptions()
+	fs := flag.NewFlagSet("regions", flag.ExitOnError)
+	latency := fs.Bool("latency", false, "measure the latency of the servers of each region and sort the regions by it")
+	format := fs.String("format", "text", "output format, text or json")
+	fs.StringVar(&opts.UpstreamProxyURL, "upstream", "", "socks5:// proxy URL psiphon and the latency probes connect through")
+	fs.StringVar(&opts.DataDirectory, "data-dir", opts.DataDirectory, "psiphon data directory, relative to 'stuff'")
+	fs.StringVar(&opts.NetworkID, "network-id", opts.NetworkID, "name of the network psiphon keeps its replay data for")
+	fs.DurationVar(&opts.EstablishTimeout, "timeout", opts.EstablishTimeout, "maximum duration of fetching the server list when none is known")
+	fs.Usage = func() {
+		log.Println("Usage: wiresocks regions [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return app.PsiphonRegions(opts, *latency, *format, os.Stdout, ctx)
+}
+
+func scanCommand(args []string) error {
+	opts := wiresocks.DefaultScanOptions()
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	format := fs.String("format", "json", "output format, json or csv")
+	license := fs.String("k", "notset", "license key")
+	cidrs := fs.String("cidr", strings.Join(opts.CIDRs, ","), "comma separated ranges to scan")
+	ports := fs.String("ports", joinInts(opts.Ports), "comma separated ports to scan")
+	fs.IntVar(&opts.PortsPerIP, "ports-per-ip", opts.PortsPerIP, "ports tried on every IP, 0 for all")
+	fs.StringVar(&opts.Network, "network", "", "name of the network the port results are recorded for")
+	fs.BoolVar(&opts.Junk, "junk", opts.Junk, "send the tunnel's junk packets ahead of every handshake")
+	fs.BoolVar(&opts.UseIPv4, "4", opts.UseIPv4, "scan IPv4 ranges")
+	fs.BoolVar(&opts.UseIPv6, "6", opts.UseIPv6, "scan IPv6 ranges")
+	fs.IntVar(&opts.Candidates, "n", opts.Candidates, "number of responsive IPs to measure")
+	fs.IntVar(&opts.Concurrency, "concurrency", opts.Concurrency, "handshakes in flight at once")
+	fs.IntVar(&opts.Samples, "samples", opts.Samples, "handshakes per endpoint")
+	fs.DurationVar(&opts.MaxRTT, "max-rtt", opts.MaxRTT, "slowest handshake to keep an endpoint")
+	fs.DurationVar(&opts.Timeout, "timeout", opts.Timeout, "maximum duration of the scan")
+	fs.Usage = func() {
+		log.Println("Usage: wiresocks scan [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) {
+		// an explicit -6 is kept whatever the connectivity
+		if f.Name == "6" {
+			opts.ProbeIPv6 = false
+		}
+	})
+
+	opts.CIDRs = strings.Split(*cidrs, ",")
+	var err error
+	if opts.Ports, err = splitInts(*ports); err != nil {
+		return fmt.Errorf("invalid -ports: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return app.Scan(opts, *license, *format, os.Stdout, ctx)
+}
+
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := fs.String("c", "", "path to the config of the server, its [Peer] sections being its clients")
+	endpoint := fs.String("e", "notset", "warp clean ip of a warp egress")
+	license := fs.String("k", "notset", "license key of a warp egress")
+	verbose := fs.Bool("v", false, "verbose")
+	fs.Usage = func() {
+		log.Println("Usage: wiresocks serve -c <config file path> [-e endpoint] [-k license] [-v]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *configFile == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return app.RunServer(*configFile, *endpoint, *license, *verbose, ctx)
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
+
+func splitInts(s string) ([]int, error) {
+	var values []int
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	var (
 		verbose        = flag.Bool("v", false, "verbose")
 		bindAddress    = flag.String("b", "127.0.0.1:8086", "socks bind address")
 		endpoint       = flag.String("e", "notset", "warp clean ip")
 		license        = flag.String("k", "notset", "license key")
-		country        = flag.String("country", "", "psiphon country code in ISO 3166-1 alpha-2 format")
+		country        = flag.String("country", "", "comma separated psiphon country codes in ISO 3166-1 alpha-2 format, tried in turn, * for any region")
 		psiphonEnabled = flag.Bool("cfon", false, "enable psiphonEnabled over warp")
-		gool           = flag.Bool("gool", false, "enable warp gooling")
+		gool           = flag.Bool("gool", false, "enable warp gooling, under psiphon too with -cfon")
+		direct         = flag.Bool("direct", false, "run psiphon without warp, through -upstream when it is a socks5 proxy")
 		scan           = flag.Bool("scan", false, "enable warp scanner(experimental)")
+		configFile     = flag.String("c", "", "path to a wiresocks config file used instead of the warp profile")
+		psiphonOpts    = psiphon.DefaultOptions()
+		psiphonProtos  = flag.String("psiphon-protocols", "", "comma separated tunnel protocols psiphon may use, all when empty")
+		upstream       = flag.String("upstream", "", "socks5 proxy to reach the endpoint through, [user:pass@]host:port, or a tcp://, tls://, ws://, wss://, http:// or https:// relay URL")
 	)
 
+	flag.BoolVar(&psiphonOpts.AutoRegion, "psiphon-auto-region", false, "try the regions with the fastest psiphon servers first, among -country when it is set")
+	flag.IntVar(&psiphonOpts.LocalHTTPProxyPort, "psiphon-http-port", 0, "port of the local HTTP proxy of psiphon, disabled when 0")
+	flag.DurationVar(&psiphonOpts.EstablishTimeout, "psiphon-timeout", psiphonOpts.EstablishTimeout, "maximum duration of an attempt to establish a psiphon tunnel")
+	flag.DurationVar(&psiphonOpts.StartTimeout, "psiphon-start-timeout", psiphonOpts.StartTimeout, "maximum duration of all the attempts to start psiphon")
+	flag.StringVar(&psiphonOpts.DataDirectory, "psiphon-data-dir", psiphonOpts.DataDirectory, "psiphon data directory, relative to 'stuff'")
+	flag.StringVar(&psiphonOpts.NetworkID, "psiphon-network-id", psiphonOpts.NetworkID, "name of the network psiphon keeps its replay data for")
 	flag.Usage = usage
 	flag.Parse()
 
-	sigchan := make(chan os.Signal)
+	var err error
+	if psiphonOpts.EgressRegions, err = psiphon.ParseRegions(*country); err != nil {
+		log.Fatal(err)
+	}
+	psiphonOpts.DisableLocalHTTPProxy = psiphonOpts.LocalHTTPProxyPort == 0
+	if *psiphonProtos != "" {
+		psiphonOpts.TunnelProtocols = strings.Split(*psiphonProtos, ",")
+	}
+
+	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// a status signal, SIGUSR1 where there is one, logs how the tunnels are
+	if len(statusSignals) > 0 {
+		statusChan := make(chan os.Signal, 1)
+		signal.Notify(statusChan, statusSignals...)
+		go func() {
+			for range statusChan {
+				log.Printf("status: %s", app.CurrentStatus())
+			}
+		}()
+	}
+
+	started := make(chan error, 1)
 	go func() {
-		err := app.RunWarp(*psiphonEnabled, *gool, *scan, *verbose, *country, *bindAddress, *endpoint, *license, ctx)
+		started <- app.RunWarp(*psiphonEnabled, *gool, *direct, *scan, *verbose, psiphonOpts, *bindAddress, *endpoint, *license, *configFile, *upstream, ctx)
+	}()
+
+	select {
+	case err := <-started:
 		if err != nil {
 			log.Fatal(err)
 		}
-	}()
-
-	<-sigchan
-	cancel()
+		<-sigchan
+		cancel()
+	case <-sigchan:
+		cancel()
+		// the tunnels being started give up
+		select {
+		case <-started:
+		case <-time.After(shutdownTimeout):
+		}
+	}
+	if !app.WaitStopped(shutdownTimeout) {
+		log.Println("psiphon did not stop in time")
+	}
 }
@@ -0,0 +1,85 @@
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// dialerScheme is the scheme of the upstream proxy URLs standing for the
+	// dialers of registerDialer, their host is the ID of the dialer
+	dialerScheme = "psiphon-dialer"
+	// dialerTimeout bounds the dials psiphon makes with no context
+	dialerTimeout = 30 * time.Second
+)
+
+// DialFunc connects to address on network, as net.Dialer.DialContext does
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dial implements proxy.Dialer for the dials psiphon makes through its
+// upstream proxy
+func (d DialFunc) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialerTimeout)
+	defer cancel()
+	return d(ctx, network, address)
+}
+
+// DialContext implements proxy.ContextDialer
+func (d DialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+var dialers struct {
+	once sync.Once
+	mu   sync.Mutex
+	next int
+	byID map[string]DialFunc
+}
+
+// registerDialer makes dial the upstream proxy of psiphon when the URL it
+// returns is its UpstreamProxyURL, until release is called. tunnel core
+// hands the URL to proxy.FromURL, which finds the dialer by its scheme.
+func registerDialer(dial DialFunc) (proxyURL string, release func()) {
+	dialers.once.Do(func() {
+		dialers.byID = make(map[string]DialFunc)
+		proxy.RegisterDialerType(dialerScheme, func(u *url.URL, _ proxy.Dialer) (proxy.Dialer, error) {
+			dialers.mu.Lock()
+			defer dialers.mu.Unlock()
+			dial, ok := dialers.byID[u.Host]
+			if !ok {
+				return nil, fmt.Errorf("upstream dialer %s is released", u.Host)
+			}
+			return dial, nil
+		})
+	})
+
+	dialers.mu.Lock()
+	defer dialers.mu.Unlock()
+	dialers.next++
+	id := strconv.Itoa(dialers.next)
+	dialers.byID[id] = dial
+	return dialerScheme + "://" + id, func() {
+		dialers.mu.Lock()
+		defer dialers.mu.Unlock()
+		delete(dialers.byID, id)
+	}
+}
+
+// withDialer returns the options with their UpstreamDialer registered as
+// UpstreamProxyURL, and the func releasing it
+func (o Options) withDialer() (Options, func()) {
+	if o.UpstreamDialer == nil {
+		return o, func() {}
+	}
+	var release func()
+	o.UpstreamProxyURL, release = registerDialer(o.UpstreamDialer)
+	o.UpstreamDialer = nil
+	return o, release
+}
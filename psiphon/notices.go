@@ -0,0 +1,203 @@
+package psiphon
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/conjure/pkg/station/log"
+)
+
+// Event is a notice of tunnel core the client reacts to, one of the *Event
+// types of this file
+type Event interface {
+	eventType() string
+}
+
+// TunnelsEvent reports how many tunnels are established, 0 when psiphon is
+// disconnected and establishing a tunnel again
+type TunnelsEvent struct {
+	Count int
+}
+
+// ConnectedServerEvent reports a successful connection to a server, which
+// may become the active tunnel
+type ConnectedServerEvent struct {
+	DiagnosticID string
+	Region       string
+	Protocol     string
+}
+
+// ActiveTunnelEvent reports the tunnel traffic goes through now, and so the
+// region it exits in
+type ActiveTunnelEvent struct {
+	DiagnosticID string
+	Region       string
+	Protocol     string
+}
+
+// UpstreamProxyErrorEvent reports a failure to connect through the upstream
+// proxy, which is warp when psiphon runs over it
+type UpstreamProxyErrorEvent struct {
+	Message string
+}
+
+// AvailableEgressRegionsEvent reports the regions psiphon has servers in
+type AvailableEgressRegionsEvent struct {
+	Regions []string
+}
+
+// ServerTimestampEvent reports the clock of the server of a tunnel
+type ServerTimestampEvent struct {
+	DiagnosticID string
+	Timestamp    time.Time
+}
+
+func (TunnelsEvent) eventType() string            { return "Tunnels" }
+func (ConnectedServerEvent) eventType() string    { return "ConnectedServer" }
+func (ActiveTunnelEvent) eventType() string       { return "ActiveTunnel" }
+func (UpstreamProxyErrorEvent) eventType() string { return "UpstreamProxyError" }
+func (ServerTimestampEvent) eventType() string    { return "ServerTimestamp" }
+func (AvailableEgressRegionsEvent) eventType() string {
+	return "AvailableEgressRegions"
+}
+
+// parseNotice maps notice to its typed event, false for the notices which
+// have none
+func parseNotice(notice NoticeEvent) (Event, bool) {
+	str := func(key string) string {
+		s, _ := notice.Data[key].(string)
+		return s
+	}
+	switch notice.Type {
+	case "Tunnels":
+		count, ok := notice.Data["count"].(float64)
+		return TunnelsEvent{Count: int(count)}, ok
+	case "ConnectedServer":
+		return ConnectedServerEvent{DiagnosticID: str("diagnosticID"), Region: str("region"), Protocol: str("protocol")}, true
+	case "ActiveTunnel":
+		return ActiveTunnelEvent{DiagnosticID: str("diagnosticID"), Protocol: str("protocol")}, true
+	case "UpstreamProxyError":
+		return UpstreamProxyErrorEvent{Message: str("message")}, true
+	case "AvailableEgressRegions":
+		var event AvailableEgressRegionsEvent
+		regions, ok := notice.Data["regions"].([]interface{})
+		for _, region := range regions {
+			if s, ok := region.(string); ok {
+				event.Regions = append(event.Regions, s)
+			}
+		}
+		return event, ok
+	case "ServerTimestamp":
+		timestamp, err := time.Parse(time.RFC3339, str("timestamp"))
+		return ServerTimestampEvent{DiagnosticID: str("diagnosticID"), Timestamp: timestamp}, err == nil
+	}
+	return nil, false
+}
+
+// Status is the health of a tunnel
+type Status struct {
+	Connected bool
+	Tunnels   int
+	// Region and Protocol are those of the active tunnel
+	Region   string
+	Protocol string
+	// ServerTime is the clock of the server of the active tunnel when it
+	// was last reported
+	ServerTime time.Time
+
+	LastUpstreamError   string
+	LastUpstreamErrorAt time.Time
+
+	// AvailableRegions are the regions psiphon has servers in
+	AvailableRegions []string
+}
+
+// statusTracker folds the events of a tunnel into its Status
+type statusTracker struct {
+	mu      sync.Mutex
+	status  Status
+	servers map[string]ConnectedServerEvent // connected servers by diagnostic ID
+}
+
+// apply updates the status with event and returns the event, an
+// ActiveTunnelEvent completed with the region of its server
+func (t *statusTracker) apply(event Event) Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e := event.(type) {
+	case TunnelsEvent:
+		t.status.Tunnels = e.Count
+		t.status.Connected = e.Count > 0
+	case ConnectedServerEvent:
+		if t.servers == nil {
+			t.servers = make(map[string]ConnectedServerEvent)
+		}
+		t.servers[e.DiagnosticID] = e
+	case ActiveTunnelEvent:
+		if server, ok := t.servers[e.DiagnosticID]; ok {
+			e.Region = server.Region
+		}
+		// the other servers connected meanwhile were discarded
+		t.servers = nil
+		t.status.Region, t.status.Protocol = e.Region, e.Protocol
+		return e
+	case UpstreamProxyErrorEvent:
+		t.status.LastUpstreamError = e.Message
+		t.status.LastUpstreamErrorAt = time.Now()
+	case ServerTimestampEvent:
+		t.status.ServerTime = e.Timestamp
+	case AvailableEgressRegionsEvent:
+		t.status.AvailableRegions = e.Regions
+	}
+	return event
+}
+
+func (t *statusTracker) get() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// eventLogger returns an event receiver logging the changes of the tunnel,
+// warning when it exits outside the requested regions. Notices come one at a
+// time, so it needs no lock.
+func eventLogger(regions []string) func(Event) {
+	connected, established := false, false
+	return func(event Event) {
+		switch e := event.(type) {
+		case TunnelsEvent:
+			if connected && e.Count == 0 {
+				log.Println("psiphon: tunnel disconnected, reconnecting...")
+			} else if !connected && e.Count > 0 && established {
+				log.Println("psiphon: tunnel connected again")
+			}
+			connected = e.Count > 0
+			established = established || connected
+		case ActiveTunnelEvent:
+			log.Printf("psiphon: active tunnel region=%s protocol=%s", e.Region, e.Protocol)
+			if len(regions) > 0 && !containsRegion(regions, e.Region) && !containsRegion(regions, "") {
+				log.Printf("psiphon: exit region %s is not one of %s", e.Region, strings.Join(regions, ","))
+			}
+		case AvailableEgressRegionsEvent:
+			if len(e.Regions) > 0 {
+				log.Printf("psiphon: available regions=%s", strings.Join(e.Regions, ","))
+			}
+		case UpstreamProxyErrorEvent:
+			log.Printf("psiphon: upstream proxy error=%q", e.Message)
+		case ServerTimestampEvent:
+			if skew := time.Since(e.Timestamp); skew > time.Hour || skew < -time.Hour {
+				log.Printf("psiphon: local clock is off by %s from the server", skew.Round(time.Minute))
+			}
+		}
+	}
+}
+
+func containsRegion(regions []string, region string) bool {
+	for _, r := range regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
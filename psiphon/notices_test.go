@@ -0,0 +1,55 @@
+package psiphon
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatusTracker(t *testing.T) {
+	notices := []string{
+		`{"noticeType":"Tunnels","data":{"count":0}}`,
+		`{"noticeType":"AvailableEgressRegions","data":{"regions":["DE","US"]}}`,
+		`{"noticeType":"UpstreamProxyError","data":{"message":"connection refused"}}`,
+		`{"noticeType":"ConnectedServer","data":{"diagnosticID":"a","region":"US","protocol":"OSSH"}}`,
+		`{"noticeType":"ConnectedServer","data":{"diagnosticID":"b","region":"DE","protocol":"QUIC-OSSH"}}`,
+		`{"noticeType":"ActiveTunnel","data":{"diagnosticID":"b","protocol":"QUIC-OSSH"}}`,
+		`{"noticeType":"Tunnels","data":{"count":1}}`,
+		`{"noticeType":"ServerTimestamp","data":{"diagnosticID":"b","timestamp":"2024-01-02T03:04:05Z"}}`,
+		`{"noticeType":"Info","data":{"message":"ignored"}}`,
+	}
+
+	var tracker statusTracker
+	var events []Event
+	for _, data := range notices {
+		var notice NoticeEvent
+		if err := json.Unmarshal([]byte(data), &notice); err != nil {
+			t.Fatal(err)
+		}
+		if event, ok := parseNotice(notice); ok {
+			events = append(events, tracker.apply(event))
+		}
+	}
+
+	if len(events) != 8 {
+		t.Fatalf("got %d events, expected 8", len(events))
+	}
+	if active := events[5].(ActiveTunnelEvent); active.Region != "DE" {
+		t.Errorf("active tunnel event has region %q", active.Region)
+	}
+
+	status := tracker.get()
+	if !status.Connected || status.Tunnels != 1 || status.Region != "DE" || status.Protocol != "QUIC-OSSH" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if !reflect.DeepEqual(status.AvailableRegions, []string{"DE", "US"}) {
+		t.Errorf("available regions %v", status.AvailableRegions)
+	}
+	if status.LastUpstreamError != "connection refused" {
+		t.Errorf("upstream error %q", status.LastUpstreamError)
+	}
+	if !status.ServerTime.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("server time %v", status.ServerTime)
+	}
+}
@@ -0,0 +1,170 @@
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	propagationChannelID               = "FFFFFFFFFFFFFFFF"
+	sponsorID                          = "FFFFFFFFFFFFFFFF"
+	remoteServerListURL                = "https://s3.amazonaws.com//psiphon/web/mjr4-p23r-puwl/server_list_compressed"
+	remoteServerListDownloadFilename   = "remote_server_list"
+	remoteServerListSignaturePublicKey = "MIICIDANBgkqhkiG9w0BAQEFAAOCAg0AMIICCAKCAgEAt7Ls+/39r+T6zNW7GiVpJfzq/xvL9SBH5rIFnk0RXYEYavax3WS6HOD35eTAqn8AniOwiH+DOkvgSKF2caqk/y1dfq47Pdymtwzp9ikpB1C5OfAysXzBiwVJlCdajBKvBZDerV1cMvRzCKvKwRmvDmHgphQQ7WfXIGbRbmmk6opMBh3roE42KcotLFtqp0RRwLtcBRNtCdsrVsjiI1Lqz/lH+T61sGjSjQ3CHMuZYSQJZo/KrvzgQXpkaCTdbObxHqb6/+i1qaVOfEsvjoiyzTxJADvSytVtcTjijhPEV6XskJVHE1Zgl+7rATr/pDQkw6DPCNBS1+Y6fy7GstZALQXwEDN/qhQI9kWkHijT8ns+i1vGg00Mk/6J75arLhqcodWsdeG/M/moWgqQAnlZAGVtJI1OgeF5fsPpXu4kctOfuZlGjVZXQNW34aOzm8r8S0eVZitPlbhcPiR4gT/aSMz/wd8lZlzZYsje/Jr8u/YtlwjjreZrGRmG8KMOzukV3lLmMppXFMvl4bxv6YFEmIuTsOhbLTwFgh7KYNjodLj/LsqRVfwz31PgWQFTEPICV7GCvgVlPRxnofqKSjgTWI4mxDhBpVcATvaoBl1L/6WLbFvBsoAUBItWwctO2xalKxF5szhGm8lccoc5MZr8kfE0uxMgsxz4er68iCID+rsCAQM="
+)
+
+// Options configure the psiphon client started by RunPsiphon
+type Options struct {
+	// EgressRegions are the ISO 3166-1 alpha-2 codes of the regions to exit
+	// in, tried in turn, any region when empty. "" stands for any region,
+	// which makes it the fallback when it comes last.
+	EgressRegions []string
+	// AutoRegion orders the regions by the latency of their servers, all the
+	// regions psiphon has servers in when EgressRegions is empty
+	AutoRegion bool
+
+	// ListenInterface is the interface the local proxies listen on, "" for
+	// loopback and "any" for all of them
+	ListenInterface string
+	// LocalSocksProxyPort and LocalHTTPProxyPort are the ports of the local
+	// proxies, a free port is picked when 0
+	LocalSocksProxyPort   int
+	LocalHTTPProxyPort    int
+	DisableLocalHTTPProxy bool
+
+	// UpstreamProxyURL is the proxy psiphon connects through, usually the
+	// socks5 proxy of warp
+	UpstreamProxyURL string
+	// UpstreamDialer, when set instead of UpstreamProxyURL, makes the
+	// connections of psiphon, such as those of the netstack of warp
+	UpstreamDialer DialFunc
+
+	// TunnelProtocols limits the protocols psiphon may use, all of them when
+	// empty
+	TunnelProtocols []string
+
+	// EstablishTimeout bounds a single attempt to establish a tunnel and
+	// StartTimeout all the attempts of RunPsiphon, none when 0
+	EstablishTimeout time.Duration
+	StartTimeout     time.Duration
+
+	// DataDirectory keeps the datastore and the server lists
+	DataDirectory  string
+	ClientPlatform string
+	NetworkID      string
+}
+
+// DefaultOptions returns the options RunPsiphon used to hard code
+func DefaultOptions() Options {
+	return Options{
+		DisableLocalHTTPProxy: true,
+		EstablishTimeout:      60 * time.Second,
+		StartTimeout:          2 * time.Minute,
+		DataDirectory:         ".",
+		ClientPlatform:        "Android_4.0.4_com.example.exampleClientLibraryApp",
+		NetworkID:             "test",
+	}
+}
+
+// ParseRegions parses comma separated egress regions, "*" standing for any
+// region
+func ParseRegions(s string) ([]string, error) {
+	var regions []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if field == "*" {
+			regions = append(regions, "")
+			continue
+		}
+		region := strings.ToUpper(field)
+		if !validRegion(region) {
+			return nil, fmt.Errorf("invalid region %q, expected an ISO 3166-1 alpha-2 code", field)
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+func validRegion(region string) bool {
+	return len(region) == 2 && region[0] >= 'A' && region[0] <= 'Z' && region[1] >= 'A' && region[1] <= 'Z'
+}
+
+// validate reports the first option psiphon would not accept
+func (o *Options) validate() error {
+	for _, region := range o.EgressRegions {
+		if region != "" && !validRegion(region) {
+			return fmt.Errorf("invalid region %q, expected an ISO 3166-1 alpha-2 code", region)
+		}
+	}
+	for _, port := range []int{o.LocalSocksProxyPort, o.LocalHTTPProxyPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if o.UpstreamProxyURL != "" && o.UpstreamDialer != nil {
+		return fmt.Errorf("psiphon takes an upstream proxy URL or an upstream dialer, not both")
+	}
+	if o.NetworkID == "" {
+		return fmt.Errorf("psiphon needs a network ID")
+	}
+	if o.EstablishTimeout < 0 || o.StartTimeout < 0 {
+		return fmt.Errorf("timeouts cannot be negative")
+	}
+	return nil
+}
+
+// tunnelConfig is the subset of the psiphon config file RunPsiphon sets
+type tunnelConfig struct {
+	EgressRegion                       string   `json:",omitempty"`
+	ListenInterface                    string   `json:",omitempty"`
+	LocalSocksProxyPort                int      `json:",omitempty"`
+	LocalHttpProxyPort                 int      `json:",omitempty"`
+	DisableLocalHTTPProxy              bool     `json:",omitempty"`
+	UpstreamProxyURL                   string   `json:",omitempty"`
+	LimitTunnelProtocols               []string `json:",omitempty"`
+	EmitDiagnosticNotices              bool
+	PropagationChannelId               string
+	SponsorId                          string
+	RemoteServerListUrl                string
+	RemoteServerListDownloadFilename   string
+	RemoteServerListSignaturePublicKey string
+}
+
+// configJSON returns the psiphon config file of the options, exiting in
+// region
+func (o *Options) configJSON(region string) ([]byte, error) {
+	return json.Marshal(tunnelConfig{
+		EgressRegion:                       region,
+		ListenInterface:                    o.ListenInterface,
+		LocalSocksProxyPort:                o.LocalSocksProxyPort,
+		LocalHttpProxyPort:                 o.LocalHTTPProxyPort,
+		DisableLocalHTTPProxy:              o.DisableLocalHTTPProxy,
+		UpstreamProxyURL:                   o.UpstreamProxyURL,
+		LimitTunnelProtocols:               o.TunnelProtocols,
+		EmitDiagnosticNotices:              true, // ConnectedServer and ActiveTunnel are diagnostic
+		PropagationChannelId:               propagationChannelID,
+		SponsorId:                          sponsorID,
+		RemoteServerListUrl:                remoteServerListURL,
+		RemoteServerListDownloadFilename:   remoteServerListDownloadFilename,
+		RemoteServerListSignaturePublicKey: remoteServerListSignaturePublicKey,
+	})
+}
+
+// parameters returns the runtime overrides of the options
+func (o *Options) parameters() Parameters {
+	dir, platform, network := o.DataDirectory, o.ClientPlatform, o.NetworkID
+	timeout := int(o.EstablishTimeout / time.Second)
+	p := Parameters{
+		DataRootDirectory:             &dir,
+		NetworkID:                     &network,
+		EstablishTunnelTimeoutSeconds: &timeout,
+	}
+	if platform != "" {
+		p.ClientPlatform = &platform
+	}
+	return p
+}
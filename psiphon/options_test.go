@@ -0,0 +1,134 @@
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRegions(t *testing.T) {
+	regions, err := ParseRegions("us, de,,GB,*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(regions, []string{"US", "DE", "GB", ""}) {
+		t.Errorf("unexpected regions %v", regions)
+	}
+	if _, err := ParseRegions(`US", "ListenInterface": "any`); err == nil {
+		t.Error("expected an error for an invalid region")
+	}
+}
+
+func TestOptionsConfigJSON(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LocalSocksProxyPort = 8086
+	opts.UpstreamProxyURL = `socks5://127.0.0.1:1080", "EgressRegion": "XX`
+	opts.TunnelProtocols = []string{"OSSH"}
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := opts.configJSON("DE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	// values cannot inject keys
+	if config["EgressRegion"] != "DE" || config["UpstreamProxyURL"] != opts.UpstreamProxyURL {
+		t.Errorf("unexpected config %s", data)
+	}
+	if config["LocalSocksProxyPort"] != float64(8086) || config["DisableLocalHTTPProxy"] != true {
+		t.Errorf("unexpected config %s", data)
+	}
+	if _, ok := config["LocalHttpProxyPort"]; ok {
+		t.Errorf("unset HTTP proxy port in config %s", data)
+	}
+}
+
+func TestRunPsiphonCanceled(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DataDirectory = t.TempDir()
+	opts.UpstreamProxyURL = "socks5://127.0.0.1:1" // nothing listens there
+	opts.EstablishTimeout = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := RunPsiphon(opts, ctx)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("psiphon connected through a closed upstream")
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("RunPsiphon did not return after its context was done")
+	}
+}
+
+func TestOrderRegions(t *testing.T) {
+	available := []string{"DE", "NL", "US"}
+	latencies := []RegionLatency{{"NL", 20 * time.Millisecond}, {"DE", 40 * time.Millisecond}, {"US", 0}}
+	for _, test := range []struct {
+		preferred []string
+		latencies []RegionLatency
+		want      []string
+		fails     bool
+	}{
+		{preferred: nil, want: []string{""}},
+		{preferred: []string{"FR", "DE"}, want: []string{"DE"}},
+		{preferred: []string{"FR", "DE", ""}, want: []string{"DE", ""}},
+		{preferred: []string{"FR"}, fails: true},
+		{preferred: nil, latencies: latencies, want: []string{"NL", "DE", ""}},
+		{preferred: []string{"DE", "NL"}, latencies: latencies, want: []string{"NL", "DE"}},
+	} {
+		got, err := orderRegions(test.preferred, available, test.latencies)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v", test.preferred, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, %v, expected %v", test.preferred, got, err, test.want)
+		}
+	}
+}
+
+func TestRunPsiphonUpstreamDialer(t *testing.T) {
+	var dials atomic.Int64
+	opts := DefaultOptions()
+	opts.DataDirectory = t.TempDir()
+	opts.EstablishTimeout = 0
+	opts.UpstreamDialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("unreachable")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := RunPsiphon(opts, ctx); err == nil {
+		t.Fatal("psiphon connected through a failing dialer")
+	}
+	if dials.Load() == 0 {
+		t.Error("psiphon did not connect through the upstream dialer")
+	}
+
+	// the dialer is released with the tunnel
+	dialers.mu.Lock()
+	defer dialers.mu.Unlock()
+	if len(dialers.byID) != 0 {
+		t.Errorf("%d dialers still registered", len(dialers.byID))
+	}
+}
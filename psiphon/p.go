@@ -7,10 +7,9 @@ import (
 	"fmt"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 	"github.com/refraction-networking/conjure/pkg/station/log"
-	"net"
 	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -56,6 +55,9 @@ type Tunnel struct {
 	embeddedServerListWaitGroup sync.WaitGroup
 	controllerWaitGroup         sync.WaitGroup
 	stopController              context.CancelFunc
+	stopOnce                    sync.Once
+	done                        chan struct{} // closed when the controller stops
+	status                      statusTracker
 
 	// The port on which the HTTP proxy is running
 	HTTPProxyPort int
@@ -97,13 +99,16 @@ var ErrTimeout = errors.New("clientlib: tunnel establishment timeout")
 //
 // noticeReceiver, if non-nil, will be called for each notice emitted by tunnel core.
 // NOTE: Ordinary users of this library should never need this and should pass nil.
+//
+// eventReceiver, if non-nil, will be called for each notice which maps to an Event.
 func StartTunnel(
 	ctx context.Context,
 	configJSON []byte,
 	embeddedServerEntryList string,
 	params Parameters,
 	paramsDelta ParametersDelta,
-	noticeReceiver func(NoticeEvent)) (retTunnel *Tunnel, retErr error) {
+	noticeReceiver func(NoticeEvent),
+	eventReceiver func(Event)) (retTunnel *Tunnel, retErr error) {
 
 	config, err := psiphon.LoadConfig(configJSON)
 	if err != nil {
@@ -160,7 +165,7 @@ func StartTunnel(
 	errored := make(chan error, 1)
 
 	// Create the tunnel object
-	tunnel := new(Tunnel)
+	tunnel := &Tunnel{done: make(chan struct{})}
 
 	// Set up notice handling
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
@@ -204,6 +209,13 @@ func StartTunnel(
 			if noticeReceiver != nil {
 				noticeReceiver(event)
 			}
+
+			if typed, ok := parseNotice(event); ok {
+				typed = tunnel.status.apply(typed)
+				if eventReceiver != nil {
+					eventReceiver(typed)
+				}
+			}
 		}))
 
 	err = psiphon.OpenDataStore(config)
@@ -266,6 +278,7 @@ func StartTunnel(
 	tunnel.controllerWaitGroup.Add(1)
 	go func() {
 		defer tunnel.controllerWaitGroup.Done()
+		defer close(tunnel.done)
 
 		// Start the tunnel. Only returns on error (or internal timeout).
 		controller.Run(controllerCtx)
@@ -303,83 +316,150 @@ func StartTunnel(
 	}
 }
 
-// Stop stops/disconnects/shuts down the tunnel. It is safe to call when not connected.
-// Not safe to call concurrently with Start.
+// Stop stops/disconnects/shuts down the tunnel. It is safe to call when not connected,
+// and more than once. Not safe to call concurrently with Start.
 func (tunnel *Tunnel) Stop() {
 	if tunnel.stopController == nil {
 		return
 	}
-	tunnel.stopController()
-	tunnel.controllerWaitGroup.Wait()
-	tunnel.embeddedServerListWaitGroup.Wait()
-	psiphon.CloseDataStore()
+	tunnel.stopOnce.Do(func() {
+		tunnel.stopController()
+		tunnel.controllerWaitGroup.Wait()
+		tunnel.embeddedServerListWaitGroup.Wait()
+		psiphon.CloseDataStore()
+	})
 }
 
-func RunPsiphon(wgBind, localSocksPort, country string, ctx context.Context) error {
-	// Embedded configuration
-	host, port, err := net.SplitHostPort(localSocksPort)
-	if err != nil {
-		return err
+// Done is closed when the tunnel stops for good, after its context is done
+// or when it could not establish a tunnel again in time.
+func (tunnel *Tunnel) Done() <-chan struct{} {
+	return tunnel.done
+}
+
+// Connected reports whether the tunnel is connected to a psiphon server now.
+// While it is not, psiphon tries to establish a tunnel again.
+func (tunnel *Tunnel) Connected() bool {
+	return tunnel.status.get().Connected
+}
+
+// Status returns the health of the tunnel and where it exits.
+func (tunnel *Tunnel) Status() Status {
+	return tunnel.status.get()
+}
+
+// RunPsiphon starts a psiphon client configured by opts, trying its egress
+// regions in turn until one of them connects or opts.StartTimeout elapses.
+// Regions psiphon has no servers in are skipped.
+// The tunnel runs until ctx is done, after which its controller is stopped
+// and the datastore closed.
+func RunPsiphon(opts Options, ctx context.Context) (*Tunnel, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
-	if strings.HasPrefix(host, "127.0.0") {
-		host = ""
-	} else {
-		host = "any"
+	opts, release := opts.withDialer()
+	tunnel, err := runPsiphon(opts, ctx)
+	if err != nil {
+		release()
+		return nil, err
 	}
-	configJSON := `{
-		"EgressRegion": "` + country + `",
-		"ListenInterface": "` + host + `",
-		"LocalSocksProxyPort": ` + port + `,
-		"UpstreamProxyURL": "socks5://` + wgBind + `",
-		"DisableLocalHTTPProxy": true,
-		"PropagationChannelId":"FFFFFFFFFFFFFFFF",
-		"RemoteServerListDownloadFilename":"remote_server_list",
-		"RemoteServerListSignaturePublicKey":"MIICIDANBgkqhkiG9w0BAQEFAAOCAg0AMIICCAKCAgEAt7Ls+/39r+T6zNW7GiVpJfzq/xvL9SBH5rIFnk0RXYEYavax3WS6HOD35eTAqn8AniOwiH+DOkvgSKF2caqk/y1dfq47Pdymtwzp9ikpB1C5OfAysXzBiwVJlCdajBKvBZDerV1cMvRzCKvKwRmvDmHgphQQ7WfXIGbRbmmk6opMBh3roE42KcotLFtqp0RRwLtcBRNtCdsrVsjiI1Lqz/lH+T61sGjSjQ3CHMuZYSQJZo/KrvzgQXpkaCTdbObxHqb6/+i1qaVOfEsvjoiyzTxJADvSytVtcTjijhPEV6XskJVHE1Zgl+7rATr/pDQkw6DPCNBS1+Y6fy7GstZALQXwEDN/qhQI9kWkHijT8ns+i1vGg00Mk/6J75arLhqcodWsdeG/M/moWgqQAnlZAGVtJI1OgeF5fsPpXu4kctOfuZlGjVZXQNW34aOzm8r8S0eVZitPlbhcPiR4gT/aSMz/wd8lZlzZYsje/Jr8u/YtlwjjreZrGRmG8KMOzukV3lLmMppXFMvl4bxv6YFEmIuTsOhbLTwFgh7KYNjodLj/LsqRVfwz31PgWQFTEPICV7GCvgVlPRxnofqKSjgTWI4mxDhBpVcATvaoBl1L/6WLbFvBsoAUBItWwctO2xalKxF5szhGm8lccoc5MZr8kfE0uxMgsxz4er68iCID+rsCAQM=",
-		"RemoteServerListUrl":"https://s3.amazonaws.com//psiphon/web/mjr4-p23r-puwl/server_list_compressed",
-		"SponsorId":"FFFFFFFFFFFFFFFF",
-		"UseIndistinguishableTLS":true
-	}`
-
-	dir := "."
-	ClientPlatform := "Android_4.0.4_com.example.exampleClientLibraryApp"
-	network := "test"
-	timeout := 60
-
-	p := Parameters{
-		DataRootDirectory:             &dir,
-		ClientPlatform:                &ClientPlatform,
-		NetworkID:                     &network,
-		EstablishTunnelTimeoutSeconds: &timeout,
-		EmitDiagnosticNoticesToFiles:  false,
+	go func() {
+		<-tunnel.Done()
+		release()
+	}()
+	return tunnel, nil
+}
+
+// runPsiphon is RunPsiphon once the upstream dialer of opts is registered
+func runPsiphon(opts Options, ctx context.Context) (*Tunnel, error) {
+	regions, err := regionsToTry(opts, ctx)
+	if err != nil {
+		return nil, err
 	}
+	p := opts.parameters()
 
 	log.Println("Handshaking, Please Wait...")
-
-	var tunnel *Tunnel
 	startTime := time.Now()
 
-	internalCtx := context.Background()
+	events := eventLogger(opts.EgressRegions)
 
-	timeoutTimer := time.NewTimer(2 * time.Minute)
-	defer timeoutTimer.Stop()
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("psiphon handshake operation canceled: %w", err)
+		}
+		if len(regions) == 0 {
+			return nil, fmt.Errorf("psiphon has no servers in any of %v", opts.EgressRegions)
+		}
 
-	for {
-		select {
-		case <-ctx.Done():
-			internalCtx.Done()
-			return fmt.Errorf("psiphon handshake operation canceled by user")
-		case <-timeoutTimer.C:
-			// Handle the internal timeout
-			internalCtx.Done()
-			return fmt.Errorf("psiphon handshake maximum time exceeded")
-		default:
-			tunnel, err = StartTunnel(internalCtx, []byte(configJSON), "", p, nil, nil)
+		region := regions[attempt%len(regions)]
+		configJSON, err := opts.configJSON(region)
+		if err != nil {
+			return nil, err
+		}
+
+		// the tunnel lives in attemptCtx, which is only canceled early when
+		// establishing it takes longer than what is left of opts.StartTimeout
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		var timer *time.Timer
+		if opts.StartTimeout > 0 {
+			left := opts.StartTimeout - time.Since(startTime)
+			if left <= 0 {
+				cancelAttempt()
+				return nil, fmt.Errorf("psiphon handshake maximum time exceeded")
+			}
+			timer = time.AfterFunc(left, cancelAttempt)
+		}
+
+		// give up on the region as soon as psiphon knows it has no servers there
+		var missing atomic.Bool
+		receiver := func(event Event) {
+			events(event)
+			if e, ok := event.(AvailableEgressRegionsEvent); ok && region != "" && len(e.Regions) > 0 && !containsRegion(e.Regions, region) {
+				missing.Store(true)
+				cancelAttempt()
+			}
+		}
+
+		tunnel, err := StartTunnel(attemptCtx, configJSON, "", p, nil, nil, receiver)
+		timedOut := timer != nil && !timer.Stop()
+		if missing.Load() {
 			if err == nil {
-				log.Println("Psiphon started successfully on port", tunnel.SOCKSProxyPort, "handshake operation took", int64(time.Since(startTime)/time.Millisecond), "milliseconds")
-				return nil
+				tunnel.Stop()
 			}
-			log.Error("Unable to start psiphon", err, "reconnecting...")
-			time.Sleep(1 * time.Second)
+			cancelAttempt()
+			log.Printf("psiphon: no servers in region %s, skipping it", region)
+			regions = removeRegion(regions, region)
+			attempt--
+			continue
+		}
+		if err == nil && timedOut {
+			// established just as the time ran out
+			tunnel.Stop()
+			err = ErrTimeout
 		}
+		if err != nil {
+			cancelAttempt()
+			if ctx.Err() == nil && !timedOut {
+				log.Error("Unable to start psiphon", err, "reconnecting...")
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		stop := tunnel.stopController
+		tunnel.stopController = func() {
+			stop()
+			cancelAttempt()
+		}
+		// release the controller and the datastore once the tunnel ends
+		go func() {
+			<-tunnel.Done()
+			tunnel.Stop()
+		}()
+
+		log.Println("Psiphon started successfully on port", tunnel.SOCKSProxyPort, "handshake operation took", int64(time.Since(startTime)/time.Millisecond), "milliseconds")
+		return tunnel, nil
 	}
 }
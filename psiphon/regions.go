@@ -0,0 +1,305 @@
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/refraction-networking/conjure/pkg/station/log"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// regionSamples is the number of servers of a region dialed to measure
+	// its latency
+	regionSamples     = 3
+	regionDialTimeout = 5 * time.Second
+)
+
+// openDataStore opens the datastore in the data directory of opts without
+// running a tunnel
+func openDataStore(opts Options) error {
+	configJSON, err := opts.configJSON("")
+	if err != nil {
+		return err
+	}
+	config, err := psiphon.LoadConfig(configJSON)
+	if err != nil {
+		return err
+	}
+	config.DataRootDirectory = opts.DataDirectory
+	config.NetworkID = opts.NetworkID
+	config.ClientPlatform = opts.ClientPlatform
+
+	// keep the notices of the commit off the terminal
+	psiphon.SetNoticeWriter(io.Discard)
+	if err := config.Commit(true); err != nil {
+		return err
+	}
+	return psiphon.OpenDataStore(config)
+}
+
+// scanServers returns the addresses of the servers of the datastore in each
+// region, at most perRegion of them, "" for the servers with no TCP port
+func scanServers(opts Options, perRegion int) (map[string][]string, error) {
+	if err := openDataStore(opts); err != nil {
+		return nil, err
+	}
+	defer psiphon.CloseDataStore()
+
+	servers := make(map[string][]string)
+	err := psiphon.ScanServerEntries(func(entry *protocol.ServerEntry) bool {
+		if entry.Region == "" || len(servers[entry.Region]) >= perRegion {
+			return true
+		}
+		port := entry.SshObfuscatedPort
+		if port == 0 {
+			port = entry.MeekServerPort
+		}
+		addr := ""
+		if port != 0 {
+			addr = net.JoinHostPort(entry.IpAddress, strconv.Itoa(port))
+		}
+		servers[entry.Region] = append(servers[entry.Region], addr)
+		return true
+	})
+	return servers, err
+}
+
+// knownRegions returns the sorted regions of the servers in the datastore
+func knownRegions(opts Options) ([]string, error) {
+	servers, err := scanServers(opts, 1)
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, 0, len(servers))
+	for region := range servers {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// DiscoverRegions returns the egress regions psiphon has servers in. When
+// none are known yet, psiphon is started until it fetched its server list
+// and reported them.
+func DiscoverRegions(opts Options, ctx context.Context) ([]string, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if regions, err := knownRegions(opts); err == nil && len(regions) > 0 {
+		return regions, nil
+	}
+	opts, release := opts.withDialer()
+	defer release()
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		regions []string
+	)
+	events := func(event Event) {
+		if e, ok := event.(AvailableEgressRegionsEvent); ok && len(e.Regions) > 0 {
+			mu.Lock()
+			regions = e.Regions
+			mu.Unlock()
+			cancel()
+		}
+	}
+
+	configJSON, err := opts.configJSON("")
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := StartTunnel(attemptCtx, configJSON, "", opts.parameters(), nil, nil, events)
+	if err == nil {
+		tunnel.Stop()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(regions) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("psiphon reported no regions: %v", err)
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// RegionLatency is how long connecting to the servers of a region takes
+type RegionLatency struct {
+	Region  string
+	Latency time.Duration // of the fastest server, 0 when none answered
+}
+
+// MeasureRegions dials a few servers of each of regions, through the upstream
+// proxy of opts when it is set, and returns the regions fastest first. The
+// regions no server of which answered come last.
+func MeasureRegions(opts Options, regions []string, ctx context.Context) ([]RegionLatency, error) {
+	dialer, err := upstreamDialer(opts)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := scanServers(opts, regionSamples)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RegionLatency, len(regions))
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i, region := range regions {
+		results[i].Region = region
+		for _, addr := range servers[region] {
+			if addr == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(result *RegionLatency, addr string) {
+				defer wg.Done()
+				latency, err := dialLatency(ctx, dialer, addr)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				if result.Latency == 0 || latency < result.Latency {
+					result.Latency = latency
+				}
+				mu.Unlock()
+			}(&results[i], addr)
+		}
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].Latency, results[j].Latency
+		return a != 0 && (b == 0 || a < b)
+	})
+	return results, nil
+}
+
+// upstreamDialer returns the upstream dialer of opts, a dialer through the
+// proxy of their upstream proxy URL, or a direct one when neither is set
+func upstreamDialer(opts Options) (proxy.ContextDialer, error) {
+	if opts.UpstreamDialer != nil {
+		return opts.UpstreamDialer, nil
+	}
+	direct := &net.Dialer{Timeout: regionDialTimeout}
+	if opts.UpstreamProxyURL == "" {
+		return direct, nil
+	}
+	u, err := url.Parse(opts.UpstreamProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("upstream proxy cannot dial with a context")
+	}
+	return contextDialer, nil
+}
+
+// dialLatency returns how long opening a TCP connection to addr takes
+func dialLatency(ctx context.Context, dialer proxy.ContextDialer, addr string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, regionDialTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	_ = conn.Close()
+	return latency, nil
+}
+
+// orderRegions returns the regions to try in turn: the preferred ones, or
+// the reachable ones fastest first when latencies are measured, then any
+// region when preferred is empty or has the "" wildcard. available, when
+// known, drops the regions psiphon has no servers in.
+func orderRegions(preferred, available []string, latencies []RegionLatency) ([]string, error) {
+	candidates := preferred
+	if latencies != nil {
+		candidates = nil
+		for _, l := range latencies {
+			if l.Latency != 0 {
+				candidates = append(candidates, l.Region)
+			}
+		}
+	}
+
+	var ordered []string
+	for _, region := range candidates {
+		if region != "" && (len(available) == 0 || containsRegion(available, region)) {
+			ordered = append(ordered, region)
+		}
+	}
+	if len(preferred) == 0 || containsRegion(preferred, "") {
+		ordered = append(ordered, "")
+	}
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("psiphon has no reachable servers in %v, available regions are %v", preferred, available)
+	}
+	return ordered, nil
+}
+
+// regionsToTry returns the regions RunPsiphon tries in turn, measuring the
+// latency of the candidates first when opts.AutoRegion is set
+func regionsToTry(opts Options, ctx context.Context) ([]string, error) {
+	// nothing is known before the first server list is fetched
+	available, err := knownRegions(opts)
+	if err != nil {
+		log.Printf("psiphon: unable to read the known regions: %v", err)
+	}
+
+	var latencies []RegionLatency
+	if opts.AutoRegion && len(available) > 0 {
+		candidates := removeRegion(opts.EgressRegions, "")
+		if len(candidates) == 0 {
+			candidates = available
+		}
+		latencies, err = MeasureRegions(opts, candidates, ctx)
+		if err != nil {
+			log.Printf("psiphon: unable to measure the regions: %v", err)
+			latencies = nil
+		}
+		for _, l := range latencies {
+			if l.Latency != 0 {
+				log.Printf("psiphon: region=%s latency=%s", l.Region, l.Latency.Round(time.Millisecond))
+			}
+		}
+	}
+	return orderRegions(opts.EgressRegions, available, latencies)
+}
+
+// removeRegion returns regions without region
+func removeRegion(regions []string, region string) []string {
+	var kept []string
+	for _, r := range regions {
+		if r != region {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
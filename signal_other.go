@@ -0,0 +1,8 @@
+//go:build windows || plan9 || js || wasip1
+
+package main
+
+import "os"
+
+// statusSignals make the proxy log its status, none without SIGUSR1
+var statusSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build !windows && !plan9 && !js && !wasip1
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals make the proxy log its status
+var statusSignals = []os.Signal{syscall.SIGUSR1}
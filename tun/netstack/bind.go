@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+
+	"github.com/bepass-org/wireguard-go/conn"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+// Bind is a conn.Bind which sends and receives over the UDP sockets of a
+// Net, so a device can use the netstack of another device as its transport.
+type Bind struct {
+	net *Net
+
+	mu         sync.Mutex
+	ipv4, ipv6 *gonet.UDPConn
+}
+
+var _ conn.Bind = (*Bind)(nil)
+
+// NewBind returns a Bind on the sockets of net.
+func NewBind(net *Net) *Bind {
+	return &Bind{net: net}
+}
+
+func (bind *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if bind.ipv4 != nil || bind.ipv6 != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	var fns []conn.ReceiveFunc
+	if bind.net.hasV4 {
+		udp4, err := bind.listen(ipv4.ProtocolNumber, port)
+		if err != nil {
+			return nil, 0, err
+		}
+		port = uint16(udp4.LocalAddr().(*net.UDPAddr).Port)
+		bind.ipv4 = udp4
+		fns = append(fns, bind.makeReceiveFunc(udp4))
+	}
+	if bind.net.hasV6 {
+		udp6, err := bind.listen(ipv6.ProtocolNumber, port)
+		if err != nil {
+			bind.closeLocked()
+			return nil, 0, err
+		}
+		port = uint16(udp6.LocalAddr().(*net.UDPAddr).Port)
+		bind.ipv6 = udp6
+		fns = append(fns, bind.makeReceiveFunc(udp6))
+	}
+	if len(fns) == 0 {
+		return nil, 0, syscall.EAFNOSUPPORT
+	}
+	return fns, port, nil
+}
+
+// listen opens a socket on port of every address of the protocol.
+func (bind *Bind) listen(protocol tcpip.NetworkProtocolNumber, port uint16) (*gonet.UDPConn, error) {
+	return gonet.DialUDP(bind.net.stack, &tcpip.FullAddress{NIC: 1, Port: port}, nil, protocol)
+}
+
+func (bind *Bind) makeReceiveFunc(udpConn *gonet.UDPConn) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, addr, err := udpConn.ReadFrom(packets[0])
+		if err != nil {
+			if bind.isClosed(udpConn) {
+				return 0, net.ErrClosed
+			}
+			return 0, err
+		}
+		addrPort := addr.(*net.UDPAddr).AddrPort()
+		sizes[0] = n
+		eps[0] = &conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())}
+		return 1, nil
+	}
+}
+
+// isClosed reports whether udpConn is no longer a socket of the bind.
+func (bind *Bind) isClosed(udpConn *gonet.UDPConn) bool {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	return udpConn != bind.ipv4 && udpConn != bind.ipv6
+}
+
+func (bind *Bind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	return bind.closeLocked()
+}
+
+func (bind *Bind) closeLocked() error {
+	var err4, err6 error
+	if bind.ipv4 != nil {
+		err4 = bind.ipv4.Close()
+		bind.ipv4 = nil
+	}
+	if bind.ipv6 != nil {
+		err6 = bind.ipv6.Close()
+		bind.ipv6 = nil
+	}
+	return errors.Join(err4, err6)
+}
+
+func (bind *Bind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (bind *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	endpoint, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	addrPort := netip.AddrPortFrom(endpoint.Addr().Unmap(), endpoint.Port())
+
+	bind.mu.Lock()
+	udpConn := bind.ipv6
+	if addrPort.Addr().Is4() {
+		udpConn = bind.ipv4
+	}
+	bind.mu.Unlock()
+	if udpConn == nil {
+		return syscall.EAFNOSUPPORT
+	}
+
+	addr := net.UDPAddrFromAddrPort(addrPort)
+	for _, buf := range bufs {
+		if _, err := udpConn.WriteTo(buf, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+func (bind *Bind) BatchSize() int {
+	return 1
+}
+
+// MTU returns the MTU of the interface of net.
+func (net *Net) MTU() int {
+	return net.mtu
+}
@@ -0,0 +1,283 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/bepass-org/wireguard-go/tun"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// forwardMaxInFlight bounds the TCP handshakes the forwarder completes at
+// once, the SYNs beyond it are dropped and retransmitted by the peer
+const forwardMaxInFlight = 1024
+
+// TCPForwardRequest is a TCP connection the peer opens to an address the
+// netstack does not listen on. Its handler must Accept or Reject it, which
+// completes or resets the handshake.
+type TCPForwardRequest struct {
+	// Local is the address the peer connects to and Remote its own
+	Local, Remote netip.AddrPort
+
+	tnet *Net
+	req  *tcp.ForwarderRequest
+	once sync.Once
+}
+
+// Accept completes the handshake and returns the connection
+func (r *TCPForwardRequest) Accept() (*gonet.TCPConn, error) {
+	err := errors.New("forwarded connection already completed")
+	var conn *gonet.TCPConn
+	r.once.Do(func() {
+		var wq waiter.Queue
+		ep, tcpipErr := r.req.CreateEndpoint(&wq)
+		if tcpipErr != nil {
+			r.req.Complete(true)
+			err = fmt.Errorf("accept %v from %v: %s", r.Local, r.Remote, tcpipErr)
+			return
+		}
+		r.req.Complete(false)
+		r.tnet.tcp.applyEndpoint(ep)
+		conn, err = gonet.NewTCPConn(&wq, ep), nil
+	})
+	return conn, err
+}
+
+// Reject resets the connection, as a closed port does
+func (r *TCPForwardRequest) Reject() {
+	r.once.Do(func() { r.req.Complete(true) })
+}
+
+// Forwarders receive what the peer sends to the addresses and ports the
+// netstack does not listen on, each in a goroutine of its own. A nil one
+// leaves its protocol to the listeners of the netstack.
+type Forwarders struct {
+	// TCP receives the connections, a request it neither accepts nor
+	// rejects is rejected once it returns
+	TCP func(*TCPForwardRequest)
+	// UDP receives a connection for each new pair of addresses, local being
+	// the one the peer sends to and remote its own. It is expected to close
+	// conn once it goes idle, the next datagram of the pair then opens a new
+	// one.
+	UDP func(conn *gonet.UDPConn, local, remote netip.AddrPort)
+	// Ping receives the ICMP echo requests, which the netstack answers by
+	// itself when it is nil
+	Ping func(*PingForwardRequest)
+}
+
+// CreateForwardingNetTUN creates a netstack device taking the packets of
+// every address, as a router or a transparent proxy does, and handing those
+// its listeners do not take to forwarders. Unlike the other netstacks, it
+// does not loop back the connections to its own addresses.
+func CreateForwardingNetTUN(localAddresses, dnsServers []netip.Addr, mtu int, tcpOpts TCPOptions, forwarders Forwarders) (tun.Device, *Net, error) {
+	// the stack takes packets from any source for its own when it handles
+	// local ones, so it would drop them all
+	dev, tnet, err := createNetTUN(localAddresses, dnsServers, mtu, tcpOpts, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tnet.enableForwarding(forwarders); err != nil {
+		dev.Close()
+		return nil, nil, err
+	}
+	if forwarders.Ping != nil {
+		tnet.ping = &pingForwarder{tun: (*netTun)(tnet), local: localAddresses, handle: forwarders.Ping}
+	}
+	return dev, tnet, nil
+}
+
+// enableForwarding makes the NIC take the packets of every address and
+// answer from them, routing both families to the peer
+func (tnet *Net) enableForwarding(forwarders Forwarders) error {
+	if tcpipErr := tnet.stack.SetPromiscuousMode(1, true); tcpipErr != nil {
+		return fmt.Errorf("SetPromiscuousMode: %v", tcpipErr)
+	}
+	if tcpipErr := tnet.stack.SetSpoofing(1, true); tcpipErr != nil {
+		return fmt.Errorf("SetSpoofing: %v", tcpipErr)
+	}
+	if !tnet.hasV4 {
+		tnet.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+	}
+	if !tnet.hasV6 {
+		tnet.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: 1})
+	}
+
+	if handle := forwarders.TCP; handle != nil {
+		forwarder := tcp.NewForwarder(tnet.stack, 0, forwardMaxInFlight, func(req *tcp.ForwarderRequest) {
+			id := req.ID()
+			r := &TCPForwardRequest{
+				Local:  endpointAddrPort(id.LocalAddress, id.LocalPort),
+				Remote: endpointAddrPort(id.RemoteAddress, id.RemotePort),
+				tnet:   tnet,
+				req:    req,
+			}
+			defer r.Reject()
+			handle(r)
+		})
+		tnet.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+	}
+	if handle := forwarders.UDP; handle != nil {
+		forwarder := udp.NewForwarder(tnet.stack, func(req *udp.ForwarderRequest) {
+			// the endpoint takes the datagram, so it is created right away
+			id := req.ID()
+			var wq waiter.Queue
+			ep, tcpipErr := req.CreateEndpoint(&wq)
+			if tcpipErr != nil {
+				return
+			}
+			conn := gonet.NewUDPConn(tnet.stack, &wq, ep)
+			go handle(conn, endpointAddrPort(id.LocalAddress, id.LocalPort), endpointAddrPort(id.RemoteAddress, id.RemotePort))
+		})
+		tnet.stack.SetTransportProtocolHandler(udp.ProtocolNumber, forwarder.HandlePacket)
+	}
+	return nil
+}
+
+func endpointAddrPort(addr tcpip.Address, port uint16) netip.AddrPort {
+	return netip.AddrPortFrom(endpointAddr(addr), port)
+}
+
+func endpointAddr(addr tcpip.Address) netip.Addr {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return ip
+}
+
+// PingForwardRequest is an ICMP echo request the peer sends to an address
+// other than those of the netstack
+type PingForwardRequest struct {
+	// Local is the address the peer pings and Remote its own
+	Local, Remote netip.Addr
+	// Ident, Seq and Data are those of the request, which the reply echoes
+	Ident, Seq uint16
+	Data       []byte
+
+	tun *netTun
+}
+
+// Reply sends the peer the echo reply of the request, as if Local answered
+func (r *PingForwardRequest) Reply() error {
+	var packet []byte
+	src, dst := tcpip.AddrFromSlice(r.Local.AsSlice()), tcpip.AddrFromSlice(r.Remote.AsSlice())
+	if r.Local.Is4() {
+		packet = make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(r.Data))
+		ip := header.IPv4(packet)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		icmp := header.ICMPv4(ip.Payload())
+		icmp.SetType(header.ICMPv4EchoReply)
+		icmp.SetIdent(r.Ident)
+		icmp.SetSequence(r.Seq)
+		copy(icmp.Payload(), r.Data)
+		icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+	} else {
+		packet = make([]byte, header.IPv6MinimumSize+header.ICMPv6EchoMinimumSize+len(r.Data))
+		ip := header.IPv6(packet)
+		ip.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(packet) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           src,
+			DstAddr:           dst,
+		})
+		icmp := header.ICMPv6(ip.Payload())
+		icmp.SetType(header.ICMPv6EchoReply)
+		icmp.SetIdent(r.Ident)
+		icmp.SetSequence(r.Seq)
+		copy(icmp.Payload(), r.Data)
+		icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header:      icmp[:header.ICMPv6EchoMinimumSize],
+			Src:         src,
+			Dst:         dst,
+			PayloadCsum: checksum.Checksum(r.Data, 0),
+			PayloadLen:  len(r.Data),
+		}))
+	}
+
+	// the reply joins the packets of the stack on their way to Read
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	defer pkb.DecRef()
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkb)
+	n, tcpipErr := r.tun.ep.WritePackets(pkts)
+	if tcpipErr != nil {
+		return fmt.Errorf("reply to %v: %s", r.Remote, tcpipErr)
+	}
+	if n == 0 {
+		return fmt.Errorf("reply to %v: queue full", r.Remote)
+	}
+	return nil
+}
+
+// pingForwarder takes the echo requests out of the inbound packets before
+// the stack answers them
+type pingForwarder struct {
+	tun    *netTun
+	local  []netip.Addr
+	handle func(*PingForwardRequest)
+}
+
+// forward hands packet to the handler when it is an echo request to an
+// address other than those of the netstack, and reports whether it did
+func (f *pingForwarder) forward(packet []byte) bool {
+	r := &PingForwardRequest{tun: f.tun}
+	switch packet[0] >> 4 {
+	case 4:
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return false
+		}
+		icmp := header.ICMPv4(ip.Payload())
+		if len(icmp) < header.ICMPv4MinimumSize || icmp.Type() != header.ICMPv4Echo || icmp.Code() != 0 {
+			return false
+		}
+		r.Local, r.Remote = endpointAddr(ip.DestinationAddress()), endpointAddr(ip.SourceAddress())
+		r.Ident, r.Seq = icmp.Ident(), icmp.Sequence()
+		r.Data = append([]byte(nil), icmp.Payload()...)
+	case 6:
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return false
+		}
+		icmp := header.ICMPv6(ip.Payload())
+		if len(icmp) < header.ICMPv6EchoMinimumSize || icmp.Type() != header.ICMPv6EchoRequest || icmp.Code() != 0 {
+			return false
+		}
+		r.Local, r.Remote = endpointAddr(ip.DestinationAddress()), endpointAddr(ip.SourceAddress())
+		r.Ident, r.Seq = icmp.Ident(), icmp.Sequence()
+		r.Data = append([]byte(nil), icmp.Payload()...)
+	default:
+		return false
+	}
+	if !r.Local.IsGlobalUnicast() {
+		return false
+	}
+	for _, addr := range f.local {
+		if addr == r.Local {
+			return false
+		}
+	}
+	go f.handle(r)
+	return true
+}
@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// forwardingNets returns a netstack at 10.0.0.1 and fd00::1 linked to a
+// forwarding one at 10.0.0.2
+func forwardingNets(t *testing.T, forwarders Forwarders) (*Net, *Net) {
+	tunA, client, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}, nil, benchMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunB, server, err := CreateForwardingNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, nil, benchMTU, DefaultTCPOptions(), forwarders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkDevices(t, tunA, tunB, 0, 1)
+	return client, server
+}
+
+func TestForwardTCP(t *testing.T) {
+	requests := make(chan *TCPForwardRequest, 1)
+	client, server := forwardingNets(t, Forwarders{TCP: func(r *TCPForwardRequest) {
+		requests <- r
+		if r.Local.Port() != 443 {
+			r.Reject()
+			return
+		}
+		conn, err := r.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}})
+
+	// the listeners of the netstack keep their connections
+	listener, err := server.ListenTCPAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := client.DialTCPAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case r := <-requests:
+		t.Fatalf("connection to a listener forwarded to %v", r.Local)
+	default:
+	}
+
+	conn, err = client.DialTCPAddrPort(netip.MustParseAddrPort("192.0.2.1:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := <-requests
+	if r.Local != netip.MustParseAddrPort("192.0.2.1:443") || r.Remote != conn.LocalAddr().(interface{ AddrPort() netip.AddrPort }).AddrPort() {
+		t.Errorf("forwarded %v from %v, expected 192.0.2.1:443 from %v", r.Local, r.Remote, conn.LocalAddr())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v through the forwarded connection", buf, err)
+	}
+
+	// a rejected connection is refused, over IPv6 which the forwarding
+	// netstack has no address of
+	if _, err := client.DialTCPAddrPort(netip.MustParseAddrPort("[2001:db8::1]:444")); err == nil {
+		t.Error("rejected connection was established")
+	}
+	if r := <-requests; r.Local != netip.MustParseAddrPort("[2001:db8::1]:444") {
+		t.Errorf("forwarded %v, expected [2001:db8::1]:444", r.Local)
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	type forwarded struct{ local, remote netip.AddrPort }
+	forwards := make(chan forwarded, 1)
+	client, _ := forwardingNets(t, Forwarders{UDP: func(conn *gonet.UDPConn, local, remote netip.AddrPort) {
+		defer conn.Close()
+		forwards <- forwarded{local, remote}
+		buf := make([]byte, 1500)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}})
+
+	conn, err := client.DialUDPAddrPort(netip.AddrPort{}, netip.MustParseAddrPort("198.51.100.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	for _, message := range []string{"first", "second"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != message {
+			t.Fatalf("read %q, %v, expected %q", buf[:n], err, message)
+		}
+	}
+
+	// both datagrams went through a single connection
+	f := <-forwards
+	if f.local != netip.MustParseAddrPort("198.51.100.1:53") || f.remote.Addr() != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("forwarded %v from %v", f.local, f.remote)
+	}
+	select {
+	case f := <-forwards:
+		t.Errorf("second connection forwarded for %v from %v", f.local, f.remote)
+	default:
+	}
+}
+
+func TestForwardPing(t *testing.T) {
+	requests := make(chan *PingForwardRequest, 1)
+	client, _ := forwardingNets(t, Forwarders{Ping: func(r *PingForwardRequest) {
+		requests <- r
+		if err := r.Reply(); err != nil {
+			t.Error(err)
+		}
+	}})
+
+	ping := func(dst string, seq int) error {
+		network, echoType, proto := "ping4", icmp.Type(ipv4.ICMPTypeEcho), 1
+		if netip.MustParseAddr(dst).Is6() {
+			network, echoType, proto = "ping6", ipv6.ICMPTypeEchoRequest, 58
+		}
+		conn, err := client.DialContext(context.Background(), network, dst)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		request, _ := (&icmp.Message{Type: echoType, Body: &icmp.Echo{Seq: seq, Data: []byte("echo")}}).Marshal(nil)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			return err
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); !ok || echo.Seq != seq || string(echo.Data) != "echo" {
+			return fmt.Errorf("unexpected reply %+v", reply)
+		}
+		return nil
+	}
+
+	if err := ping("192.0.2.1", 1); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.Local != netip.MustParseAddr("192.0.2.1") || r.Remote != netip.MustParseAddr("10.0.0.1") || r.Seq != 1 || string(r.Data) != "echo" {
+		t.Errorf("unexpected request %+v", r)
+	}
+
+	if err := ping("2001:db8::2", 3); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-requests; r.Local != netip.MustParseAddr("2001:db8::2") || r.Remote != netip.MustParseAddr("fd00::1") {
+		t.Errorf("unexpected request %+v", r)
+	}
+
+	// the netstack still answers for itself
+	if err := ping("10.0.0.2", 2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-requests:
+		t.Errorf("ping of the netstack forwarded to %v", r.Local)
+	default:
+	}
+}
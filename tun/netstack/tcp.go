@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// TCPOptions tune the TCP connections of a netstack
+type TCPOptions struct {
+	// ReceiveBufferSize and SendBufferSize are the initial buffer sizes of a
+	// connection, in bytes, and the Max sizes those the stack may grow them
+	// to. They bound the data in flight, so the throughput of paths with a
+	// long round trip.
+	ReceiveBufferSize    int
+	MaxReceiveBufferSize int
+	SendBufferSize       int
+	MaxSendBufferSize    int
+	// ModerateReceiveBuffer grows the receive buffer with the throughput of
+	// the connection, up to MaxReceiveBufferSize
+	ModerateReceiveBuffer bool
+	// CongestionControl is "cubic" or "reno"
+	CongestionControl string
+	SACK              bool
+
+	// KeepaliveIdle is how long a connection stays idle before keepalives
+	// are sent, none when 0. KeepaliveCount unanswered keepalives, sent
+	// every KeepaliveInterval, close it.
+	KeepaliveIdle     time.Duration
+	KeepaliveInterval time.Duration
+	KeepaliveCount    int
+	// NoDelay sends small writes right away instead of coalescing them with
+	// Nagle's algorithm
+	NoDelay bool
+	// QuickAck acknowledges every segment right away instead of delaying
+	// the acknowledgements
+	QuickAck bool
+}
+
+// DefaultTCPOptions are tuned for throughput over tunnels with a long round
+// trip, and keep idle connections alive through the NATs on the way
+func DefaultTCPOptions() TCPOptions {
+	return TCPOptions{
+		ReceiveBufferSize:     1 << 20,
+		MaxReceiveBufferSize:  8 << 20,
+		SendBufferSize:        1 << 20,
+		MaxSendBufferSize:     8 << 20,
+		ModerateReceiveBuffer: true,
+		CongestionControl:     "cubic",
+		SACK:                  true,
+		KeepaliveIdle:         60 * time.Second,
+		KeepaliveInterval:     15 * time.Second,
+		KeepaliveCount:        4,
+		NoDelay:               true,
+	}
+}
+
+// GVisorTCPOptions are the defaults of gvisor, with SACK enabled as the
+// netstack always had it
+func GVisorTCPOptions() TCPOptions {
+	return TCPOptions{
+		ReceiveBufferSize:     tcp.DefaultReceiveBufferSize,
+		MaxReceiveBufferSize:  tcp.MaxBufferSize,
+		SendBufferSize:        tcp.DefaultSendBufferSize,
+		MaxSendBufferSize:     tcp.MaxBufferSize,
+		ModerateReceiveBuffer: true,
+		CongestionControl:     "reno",
+		SACK:                  true,
+		NoDelay:               true,
+	}
+}
+
+// Validate reports the first option the stack would not accept
+func (o *TCPOptions) Validate() error {
+	if o.CongestionControl != "cubic" && o.CongestionControl != "reno" {
+		return fmt.Errorf("unknown congestion control %q, expected cubic or reno", o.CongestionControl)
+	}
+	if o.ReceiveBufferSize < tcp.MinBufferSize || o.MaxReceiveBufferSize < o.ReceiveBufferSize {
+		return fmt.Errorf("receive buffer sizes %d and %d should be at least %d and in order", o.ReceiveBufferSize, o.MaxReceiveBufferSize, tcp.MinBufferSize)
+	}
+	if o.SendBufferSize < tcp.MinBufferSize || o.MaxSendBufferSize < o.SendBufferSize {
+		return fmt.Errorf("send buffer sizes %d and %d should be at least %d and in order", o.SendBufferSize, o.MaxSendBufferSize, tcp.MinBufferSize)
+	}
+	if o.KeepaliveIdle < 0 || o.KeepaliveInterval < 0 || o.KeepaliveCount < 0 {
+		return errors.New("keepalive settings cannot be negative")
+	}
+	if o.KeepaliveIdle > 0 && (o.KeepaliveInterval == 0 || o.KeepaliveCount == 0) {
+		return errors.New("keepalives need an interval and a count")
+	}
+	return nil
+}
+
+// applyStack sets the options shared by every connection of s
+func (o *TCPOptions) applyStack(s *stack.Stack) error {
+	sack := tcpip.TCPSACKEnabled(o.SACK)
+	receive := tcpip.TCPReceiveBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: o.ReceiveBufferSize, Max: o.MaxReceiveBufferSize}
+	send := tcpip.TCPSendBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: o.SendBufferSize, Max: o.MaxSendBufferSize}
+	moderate := tcpip.TCPModerateReceiveBufferOption(o.ModerateReceiveBuffer)
+	congestion := tcpip.CongestionControlOption(o.CongestionControl)
+	delay := tcpip.TCPDelayEnabled(!o.NoDelay)
+	for _, option := range []tcpip.SettableTransportProtocolOption{&sack, &receive, &send, &moderate, &congestion, &delay} {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, option); err != nil {
+			return fmt.Errorf("could not set TCP option %T: %v", option, err)
+		}
+	}
+	return nil
+}
+
+// applyEndpoint sets the options of a single connection on ep, which the
+// connections accepted by a listening ep inherit
+func (o *TCPOptions) applyEndpoint(ep tcpip.Endpoint) {
+	ep.SocketOptions().SetDelayOption(!o.NoDelay)
+	ep.SocketOptions().SetQuickAck(o.QuickAck)
+	if o.KeepaliveIdle <= 0 {
+		return
+	}
+	idle := tcpip.KeepaliveIdleOption(o.KeepaliveIdle)
+	interval := tcpip.KeepaliveIntervalOption(o.KeepaliveInterval)
+	_ = ep.SetSockOpt(&idle)
+	_ = ep.SetSockOpt(&interval)
+	_ = ep.SetSockOptInt(tcpip.KeepaliveCountOption, o.KeepaliveCount)
+	ep.SocketOptions().SetKeepAlive(true)
+}
+
+// dialTCP is gonet.DialContextTCP with the options of the netstack set on
+// the endpoint before it connects
+func (tnet *Net) dialTCP(ctx context.Context, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*gonet.TCPConn, error) {
+	var wq waiter.Queue
+	ep, tcpipErr := tnet.stack.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	tnet.tcp.applyEndpoint(ep)
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	select {
+	case <-ctx.Done():
+		ep.Close()
+		return nil, ctx.Err()
+	default:
+	}
+
+	tcpipErr = ep.Connect(addr)
+	if _, ok := tcpipErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpipErr = ep.LastError()
+	}
+	if tcpipErr != nil {
+		ep.Close()
+		return nil, tcpOpError("connect", addr, tcpipErr)
+	}
+	return gonet.NewTCPConn(&wq, ep), nil
+}
+
+// listenTCP is gonet.ListenTCP with the options of the netstack set on the
+// listening endpoint
+func (tnet *Net) listenTCP(addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*gonet.TCPListener, error) {
+	var wq waiter.Queue
+	ep, tcpipErr := tnet.stack.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	tnet.tcp.applyEndpoint(ep)
+
+	if tcpipErr := ep.Bind(addr); tcpipErr != nil {
+		ep.Close()
+		return nil, tcpOpError("bind", addr, tcpipErr)
+	}
+	if tcpipErr := ep.Listen(10); tcpipErr != nil {
+		ep.Close()
+		return nil, tcpOpError("listen", addr, tcpipErr)
+	}
+	return gonet.NewTCPListener(tnet.stack, &wq, ep), nil
+}
+
+func tcpOpError(op string, addr tcpip.FullAddress, err tcpip.Error) *net.OpError {
+	return &net.OpError{
+		Op:   op,
+		Net:  "tcp",
+		Addr: &net.TCPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)},
+		Err:  errors.New(err.String()),
+	}
+}
@@ -19,9 +19,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/bepass-org/wireguard-go/conn"
 	"github.com/bepass-org/wireguard-go/tun"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -39,39 +41,77 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
+const (
+	// queueSize is the number of outbound packets the stack queues for Read
+	queueSize = 4096
+	// queueHighWater is how many of them make the stack wait for Read, with
+	// room left for the packets of the writers already past the check
+	queueHighWater = queueSize - 512
+	// groTimeout is how long inbound TCP segments may wait to be merged
+	// with the next ones of their connection
+	groTimeout = 50 * time.Microsecond
+)
+
 type netTun struct {
-	ep             *channel.Endpoint
-	stack          *stack.Stack
-	events         chan tun.Event
-	incomingPacket chan *buffer.View
-	mtu            int
-	dnsServers     []netip.Addr
-	hasV4, hasV6   bool
+	ep           *channel.Endpoint
+	stack        *stack.Stack
+	events       chan tun.Event
+	mtu          int
+	dnsServers   []netip.Addr
+	dnsMutex     sync.RWMutex
+	hasV4, hasV6 bool
+	tcp          TCPOptions
+
+	// queueMu and queueRead make the writers of the stack wait for Read
+	// while the queue is nearly full, rather than have it drop packets
+	queueMu   sync.Mutex
+	queueRead *sync.Cond
+	closed    bool
+
+	// ping takes the echo requests of a forwarding netstack
+	ping *pingForwarder
 }
 
 type Net netTun
 
+// CreateNetTUN creates a netstack device with the default TCP options
 func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	return CreateNetTUNWithOptions(localAddresses, dnsServers, mtu, DefaultTCPOptions())
+}
+
+// CreateNetTUNWithOptions creates a netstack device whose TCP connections are
+// tuned by tcpOpts
+func CreateNetTUNWithOptions(localAddresses, dnsServers []netip.Addr, mtu int, tcpOpts TCPOptions) (tun.Device, *Net, error) {
+	return createNetTUN(localAddresses, dnsServers, mtu, tcpOpts, true)
+}
+
+// createNetTUN creates a netstack device, whose connections to its own
+// addresses loop back inside of it when handleLocal is set
+func createNetTUN(localAddresses, dnsServers []netip.Addr, mtu int, tcpOpts TCPOptions, handleLocal bool) (tun.Device, *Net, error) {
+	if err := tcpOpts.Validate(); err != nil {
+		return nil, nil, err
+	}
 	opts := stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4},
-		HandleLocal:        true,
+		HandleLocal:        handleLocal,
 	}
 	dev := &netTun{
-		ep:             channel.New(1024, uint32(mtu), ""),
-		stack:          stack.New(opts),
-		events:         make(chan tun.Event, 10),
-		incomingPacket: make(chan *buffer.View),
-		dnsServers:     dnsServers,
-		mtu:            mtu,
-	}
-	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
-	tcpipErr := dev.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
-	if tcpipErr != nil {
-		return nil, nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
-	}
+		ep:         channel.New(queueSize, uint32(mtu), ""),
+		stack:      stack.New(opts),
+		events:     make(chan tun.Event, 10),
+		dnsServers: dnsServers,
+		mtu:        mtu,
+		tcp:        tcpOpts,
+	}
+	dev.queueRead = sync.NewCond(&dev.queueMu)
+	if err := tcpOpts.applyStack(dev.stack); err != nil {
+		return nil, nil, err
+	}
+	// TCP hands over batches of segments instead of one at a time
+	dev.ep.SupportedGSOKind = stack.GvisorGSOSupported
 	dev.ep.AddNotify(dev)
-	tcpipErr = dev.stack.CreateNIC(1, dev.ep)
+	tcpipErr := dev.stack.CreateNICWithOptions(1, dev.ep, stack.NICOptions{GROTimeout: groTimeout})
 	if tcpipErr != nil {
 		return nil, nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
 	}
@@ -119,18 +159,35 @@ func (tun *netTun) Events() <-chan tun.Event {
 	return tun.events
 }
 
+// Read waits for an outbound packet and returns it with the others already
+// queued, up to len(buf)
 func (tun *netTun) Read(buf [][]byte, sizes []int, offset int) (int, error) {
-	view, ok := <-tun.incomingPacket
-	if !ok {
+	pkt := tun.ep.ReadContext(context.Background())
+	if pkt.IsNil() {
 		return 0, os.ErrClosed
 	}
 
-	n, err := view.Read(buf[0][offset:])
-	if err != nil {
-		return 0, err
+	n := 0
+	for {
+		size := 0
+		for _, slice := range pkt.AsSlices() {
+			size += copy(buf[n][offset+size:], slice)
+		}
+		pkt.DecRef()
+		sizes[n] = size
+		n++
+		if n == len(buf) {
+			break
+		}
+		if pkt = tun.ep.Read(); pkt.IsNil() {
+			break
+		}
 	}
-	sizes[0] = n
-	return 1, nil
+
+	tun.queueMu.Lock()
+	tun.queueRead.Broadcast()
+	tun.queueMu.Unlock()
+	return n, nil
 }
 
 func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
@@ -139,6 +196,9 @@ func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
 		if len(packet) == 0 {
 			continue
 		}
+		if tun.ping != nil && tun.ping.forward(packet) {
+			continue
+		}
 
 		pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
 		switch packet[0] >> 4 {
@@ -153,19 +213,28 @@ func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
 	return len(buf), nil
 }
 
+// WriteNotify is called by the writers of the stack after they queue a
+// packet, and holds them back while the queue is nearly full, so TCP slows
+// down instead of losing segments
 func (tun *netTun) WriteNotify() {
-	pkt := tun.ep.Read()
-	if pkt.IsNil() {
-		return
+	tun.queueMu.Lock()
+	for tun.ep.NumQueued() >= queueHighWater && !tun.closed {
+		tun.queueRead.Wait()
 	}
-
-	view := pkt.ToView()
-	pkt.DecRef()
-
-	tun.incomingPacket <- view
+	tun.queueMu.Unlock()
 }
 
 func (tun *netTun) Close() error {
+	// release the writers waiting for Read first
+	tun.queueMu.Lock()
+	closed := tun.closed
+	tun.closed = true
+	tun.queueRead.Broadcast()
+	tun.queueMu.Unlock()
+	if closed {
+		return nil
+	}
+
 	tun.stack.RemoveNIC(1)
 
 	if tun.events != nil {
@@ -174,10 +243,6 @@ func (tun *netTun) Close() error {
 
 	tun.ep.Close()
 
-	if tun.incomingPacket != nil {
-		close(tun.incomingPacket)
-	}
-
 	return nil
 }
 
@@ -186,7 +251,7 @@ func (tun *netTun) MTU() (int, error) {
 }
 
 func (tun *netTun) BatchSize() int {
-	return 1
+	return conn.IdealBatchSize
 }
 
 func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
@@ -205,7 +270,7 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 
 func (net *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
 	fa, pn := convertToFullAddr(addr)
-	return gonet.DialContextTCP(ctx, net.stack, fa, pn)
+	return net.dialTCP(ctx, fa, pn)
 }
 
 func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -217,8 +282,7 @@ func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.T
 }
 
 func (net *Net) DialTCPAddrPort(addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
-	return gonet.DialTCP(net.stack, fa, pn)
+	return net.DialContextTCPAddrPort(context.Background(), addr)
 }
 
 func (net *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -231,7 +295,7 @@ func (net *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
 
 func (net *Net) ListenTCPAddrPort(addr netip.AddrPort) (*gonet.TCPListener, error) {
 	fa, pn := convertToFullAddr(addr)
-	return gonet.ListenTCP(net.stack, fa, pn)
+	return net.listenTCP(fa, pn)
 }
 
 func (net *Net) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
@@ -754,8 +818,12 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 		Class: dnsmessage.ClassINET,
 	}
 
+	tnet.dnsMutex.RLock()
+	dnsServers := tnet.dnsServers
+	tnet.dnsMutex.RUnlock()
+
 	for i := 0; i < 2; i++ {
-		for _, server := range tnet.dnsServers {
+		for _, server := range dnsServers {
 			p, h, err := tnet.exchange(ctx, server, q, time.Second*5)
 			if err != nil {
 				dnsErr := &net.DNSError{
@@ -808,6 +876,13 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 	return dnsmessage.Parser{}, "", lastErr
 }
 
+// SetDNSServers replaces the servers used to resolve names on the tunnel.
+func (tnet *Net) SetDNSServers(dnsServers []netip.Addr) {
+	tnet.dnsMutex.Lock()
+	tnet.dnsServers = dnsServers
+	tnet.dnsMutex.Unlock()
+}
+
 func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string, error) {
 	if host == "" || (!tnet.hasV6 && !tnet.hasV4) {
 		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
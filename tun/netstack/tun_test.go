@@ -0,0 +1,290 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"io"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+	"github.com/bepass-org/wireguard-go/tun"
+)
+
+const benchMTU = 1420
+
+// delayedLink carries the packets of from to to after delay, as a path with a
+// round trip of twice delay does, and drops them while cut is set. Packets
+// are read batch at a time, and written so too when there is no delay.
+func delayedLink(from, to tun.Device, delay time.Duration, batch int, cut *atomic.Bool) {
+	if delay == 0 {
+		go func() {
+			bufs, sizes := make([][]byte, batch), make([]int, batch)
+			for i := range bufs {
+				bufs[i] = make([]byte, benchMTU)
+			}
+			packets := make([][]byte, 0, batch)
+			for {
+				n, err := from.Read(bufs, sizes, 0)
+				if err != nil {
+					return
+				}
+				if cut.Load() {
+					continue
+				}
+				packets = packets[:0]
+				for i := 0; i < n; i++ {
+					packets = append(packets, bufs[i][:sizes[i]])
+				}
+				if _, err := to.Write(packets, 0); err != nil {
+					return
+				}
+			}
+		}()
+		return
+	}
+
+	type packet struct {
+		data []byte
+		at   time.Time
+	}
+	queue := make(chan packet, 1<<15)
+	go func() {
+		defer close(queue)
+		bufs, sizes := make([][]byte, batch), make([]int, batch)
+		for {
+			for i := range bufs {
+				bufs[i] = make([]byte, benchMTU)
+			}
+			n, err := from.Read(bufs, sizes, 0)
+			if err != nil {
+				return
+			}
+			at := time.Now().Add(delay)
+			for i := 0; i < n; i++ {
+				queue <- packet{data: bufs[i][:sizes[i]], at: at}
+			}
+		}
+	}()
+	go func() {
+		for p := range queue {
+			time.Sleep(time.Until(p.at))
+			if cut.Load() {
+				continue
+			}
+			if _, err := to.Write([][]byte{p.data}, 0); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// linkedNets returns two netstacks with opts at 10.0.0.1 and 10.0.0.2,
+// linked with a round trip of rtt until the returned bool is set, reading
+// batch packets at a time
+func linkedNets(t testing.TB, opts TCPOptions, rtt time.Duration, batch int) (*Net, *Net, *atomic.Bool) {
+	tunA, netA, err := CreateNetTUNWithOptions([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, benchMTU, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunB, netB, err := CreateNetTUNWithOptions([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, nil, benchMTU, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netA, netB, linkDevices(t, tunA, tunB, rtt, batch)
+}
+
+// linkDevices links tunA and tunB as linkedNets does, and closes them with
+// the test
+func linkDevices(t testing.TB, tunA, tunB tun.Device, rtt time.Duration, batch int) *atomic.Bool {
+	cut := new(atomic.Bool)
+	delayedLink(tunA, tunB, rtt/2, batch, cut)
+	delayedLink(tunB, tunA, rtt/2, batch, cut)
+	t.Cleanup(func() {
+		tunA.Close()
+		tunB.Close()
+	})
+	return cut
+}
+
+func TestTCPOptionsValidate(t *testing.T) {
+	for _, opts := range []TCPOptions{DefaultTCPOptions(), GVisorTCPOptions()} {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("%+v: %v", opts, err)
+		}
+	}
+	opts := DefaultTCPOptions()
+	opts.CongestionControl = "bbr"
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for an unknown congestion control")
+	}
+	opts = DefaultTCPOptions()
+	opts.MaxReceiveBufferSize = opts.ReceiveBufferSize - 1
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a receive buffer larger than its maximum")
+	}
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.KeepaliveIdle = time.Second
+	opts.KeepaliveInterval = time.Second
+	opts.KeepaliveCount = 2
+	netA, netB, cut := linkedNets(t, opts, 0, 1)
+
+	listener, err := netB.ListenTCPAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	conn, err := netA.DialTCPAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// an idle connection whose peer answers keepalives stays open
+	time.Sleep(3 * time.Second)
+	if _, err := conn.Write([]byte("alive")); err != nil {
+		t.Fatal(err)
+	}
+
+	// and is closed once the peer is gone, after the write is acknowledged
+	time.Sleep(100 * time.Millisecond)
+	cut.Store(true)
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || time.Since(start) >= 10*time.Second {
+		t.Fatalf("connection to a gone peer still open after %s: %v", time.Since(start), err)
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	dev, tnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, benchMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	udp, err := tnet.DialUDPAddrPort(netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.2:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	const packets = 8
+	for i := 0; i < packets; i++ {
+		if _, err := udp.Write([]byte("datagram")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the queued packets come in a single read, one per buffer
+	bufs, sizes := make([][]byte, dev.BatchSize()), make([]int, dev.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, 16+benchMTU)
+	}
+	n, err := dev.Read(bufs, sizes, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != packets {
+		t.Fatalf("read %d packets, expected %d", n, packets)
+	}
+	for i := 0; i < n; i++ {
+		if sizes[i] != 20+8+len("datagram") || bufs[i][16]>>4 != 4 {
+			t.Errorf("packet %d: unexpected %d bytes %x", i, sizes[i], bufs[i][16:16+sizes[i]])
+		}
+	}
+
+	dev.Close()
+	if _, err := dev.Read(bufs, sizes, 0); err == nil {
+		t.Error("read from a closed device")
+	}
+}
+
+// BenchmarkTCPThroughput sends over a single connection through paths with
+// a long round trip, with the options of gvisor and the default ones
+func BenchmarkTCPThroughput(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts TCPOptions
+	}{
+		{"gvisor", GVisorTCPOptions()},
+		{"default", DefaultTCPOptions()},
+	} {
+		for _, rtt := range []time.Duration{20 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond} {
+			b.Run(bench.name+"/rtt="+rtt.String(), func(b *testing.B) {
+				benchmarkTCPThroughput(b, bench.opts, rtt, conn.IdealBatchSize)
+			})
+		}
+	}
+}
+
+// BenchmarkTCPBatch sends over a single connection through a path with no
+// delay, reading the packets of the netstacks one or a batch at a time
+func BenchmarkTCPBatch(b *testing.B) {
+	for _, batch := range []int{1, conn.IdealBatchSize} {
+		b.Run("batch="+strconv.Itoa(batch), func(b *testing.B) {
+			benchmarkTCPThroughput(b, DefaultTCPOptions(), 0, batch)
+		})
+	}
+}
+
+func benchmarkTCPThroughput(b *testing.B, opts TCPOptions, rtt time.Duration, batch int) {
+	netA, netB, _ := linkedNets(b, opts, rtt, batch)
+	listener, err := netB.ListenTCPAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	const chunk = 1 << 20
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	conn, err := netA.DialTCPAddrPort(netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// leave slow start before measuring
+	buf := make([]byte, chunk)
+	for i := 0; i < 8; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.Close()
+	if n := <-received; n != int64(b.N+8)*chunk {
+		b.Fatalf("received %d bytes, sent %d", n, int64(b.N+8)*chunk)
+	}
+	b.StopTimer()
+}
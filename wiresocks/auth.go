@@ -0,0 +1,160 @@
+package wiresocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	errSocks5NoUserPassAuth = errors.New("socks5 client does not support username/password authentication")
+	errAuthFailed           = errors.New("proxy authentication failed")
+)
+
+// replayConn replays the bytes in replay before reading from the underlying
+// connection and silently drops the first discard bytes written to it. It is
+// used to hand an already authenticated connection to a proxy server that
+// only supports unauthenticated clients.
+type replayConn struct {
+	net.Conn
+	replay  io.Reader
+	discard int
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	if c.replay != nil {
+		n, err := c.replay.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		c.replay = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	if c.discard > 0 {
+		skip := c.discard
+		if skip > len(p) {
+			skip = len(p)
+		}
+		c.discard -= skip
+		n, err := c.Conn.Write(p[skip:])
+		return n + skip, err
+	}
+	return c.Conn.Write(p)
+}
+
+func credentialsEqual(username, password, expectedUsername, expectedPassword string) bool {
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
+	return userOk && passOk
+}
+
+// socks5Authenticate runs the RFC 1929 username/password negotiation on conn
+// and returns a connection that presents a "no authentication" greeting to
+// the socks5 server that handles the rest of the request.
+func socks5Authenticate(conn net.Conn, username, password string) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x05 {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, 0x02) == -1 {
+		_, _ = conn.Write([]byte{0x05, 0xff})
+		return nil, errSocks5NoUserPassAuth
+	}
+	if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+		return nil, err
+	}
+
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x01 {
+		return nil, fmt.Errorf("unsupported auth version: %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, err
+	}
+	pass := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return nil, err
+	}
+
+	if !credentialsEqual(string(user), string(pass), username, password) {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return nil, errAuthFailed
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return nil, err
+	}
+
+	// the socks5 server answers the replayed greeting with 2 bytes
+	return &replayConn{
+		Conn:    conn,
+		replay:  bytes.NewReader([]byte{0x05, 0x01, 0x00}),
+		discard: 2,
+	}, nil
+}
+
+// httpAuthenticate checks the Proxy-Authorization header of the first request
+// on conn and returns a connection that replays that request to the http
+// proxy server.
+func httpAuthenticate(conn net.Conn, username, password string) (net.Conn, error) {
+	var consumed bytes.Buffer
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(conn, &consumed)))
+	if err != nil {
+		return nil, err
+	}
+
+	user, pass, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+	if !ok || !credentialsEqual(user, pass, username, password) {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"wiresocks\"\r\n"+
+			"Content-Length: 0\r\n\r\n")
+		return nil, errAuthFailed
+	}
+
+	return &replayConn{
+		Conn:   conn,
+		replay: &consumed,
+	}, nil
+}
+
+func parseProxyAuthorization(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
@@ -0,0 +1,146 @@
+package wiresocks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// authenticate runs auth on the server end of a pipe while client talks to
+// it, and returns the result of auth
+func authenticate(t *testing.T, auth func(net.Conn) (net.Conn, error), client func(conn net.Conn)) (net.Conn, error) {
+	server, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		clientConn.Close()
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client(clientConn)
+	}()
+	conn, err := auth(server)
+	if err != nil {
+		// the client may still wait for the rest of an exchange
+		server.Close()
+	}
+	<-done
+	return conn, err
+}
+
+func socks5Greet(t *testing.T, conn net.Conn, methods []byte, username, password string) []byte {
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		t.Error(err)
+		return nil
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x02 {
+		return reply
+	}
+	request := append([]byte{0x01, byte(len(username))}, username...)
+	request = append(append(request, byte(len(password))), password...)
+	if _, err := conn.Write(request); err != nil {
+		t.Error(err)
+		return nil
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Error(err)
+	}
+	return reply
+}
+
+func TestSocks5Authenticate(t *testing.T) {
+	auth := func(conn net.Conn) (net.Conn, error) { return socks5Authenticate(conn, "user", "secret") }
+
+	var reply []byte
+	_, err := authenticate(t, auth, func(conn net.Conn) {
+		reply = socks5Greet(t, conn, []byte{0x00, 0x02}, "user", "wrong")
+	})
+	if !errors.Is(err, errAuthFailed) || !bytes.Equal(reply, []byte{0x01, 0x01}) {
+		t.Errorf("wrong password: %v, replied %x", err, reply)
+	}
+
+	_, err = authenticate(t, auth, func(conn net.Conn) {
+		reply = socks5Greet(t, conn, []byte{0x00}, "", "")
+	})
+	if !errors.Is(err, errSocks5NoUserPassAuth) || !bytes.Equal(reply, []byte{0x05, 0xff}) {
+		t.Errorf("no username/password method: %v, replied %x", err, reply)
+	}
+
+	var client net.Conn
+	conn, err := authenticate(t, auth, func(conn net.Conn) {
+		reply = socks5Greet(t, conn, []byte{0x00, 0x02}, "user", "secret")
+		client = conn
+	})
+	if err != nil || !bytes.Equal(reply, []byte{0x01, 0x00}) {
+		t.Fatalf("right password: %v, replied %x", err, reply)
+	}
+
+	// the proxy reads a greeting without authentication, then the client
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil || !bytes.Equal(greeting, []byte{0x05, 0x01, 0x00}) {
+		t.Fatalf("replayed greeting %x, %v", greeting, err)
+	}
+	go func() { _, _ = client.Write([]byte("request")) }()
+	request := make([]byte, len("request"))
+	if _, err := io.ReadFull(conn, request); err != nil || string(request) != "request" {
+		t.Fatalf("read %q, %v after the greeting", request, err)
+	}
+
+	// and its answer to the greeting never reaches the client
+	go func() { _, _ = conn.Write([]byte{0x05, 0x00, 'o', 'k'}) }()
+	answer := make([]byte, 2)
+	if _, err := io.ReadFull(client, answer); err != nil || string(answer) != "ok" {
+		t.Errorf("client read %q, %v", answer, err)
+	}
+}
+
+func TestHTTPAuthenticate(t *testing.T) {
+	auth := func(conn net.Conn) (net.Conn, error) { return httpAuthenticate(conn, "user", "secret") }
+	request := func(authorization string) func(net.Conn) {
+		return func(conn net.Conn) {
+			req := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"
+			if authorization != "" {
+				req += "Proxy-Authorization: " + authorization + "\r\n"
+			}
+			go func() { _, _ = conn.Write([]byte(req + "\r\n")) }()
+		}
+	}
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	for name, authorization := range map[string]string{
+		"wrong password": basic("user:wrong"),
+		"no credentials": "",
+		"other scheme":   "Bearer token",
+	} {
+		var status string
+		_, err := authenticate(t, auth, func(conn net.Conn) {
+			request(authorization)(conn)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err == nil {
+				status = resp.Status
+			}
+		})
+		if !errors.Is(err, errAuthFailed) || status != "407 Proxy Authentication Required" {
+			t.Errorf("%s: %v, answered %q", name, err, status)
+		}
+	}
+
+	conn, err := authenticate(t, auth, request(basic("user:secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the proxy reads the request as the client sent it
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect || req.Host != "example.com:443" {
+		t.Errorf("replayed request %+v, %v", req, err)
+	}
+}
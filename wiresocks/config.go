@@ -5,9 +5,13 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/bepass-org/wireguard-go/tun/netstack"
 	"github.com/bepass-org/wireguard-go/warp"
+	"io"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -26,16 +30,36 @@ type PeerConfig struct {
 
 // DeviceConfig contains the information to initiate a wireguard connection
 type DeviceConfig struct {
-	SecretKey  string
-	Endpoint   []netip.Addr
+	SecretKey string
+	Endpoint  []netip.Addr
+	// Subnets are the prefixes of Address, a server allocates the addresses
+	// of its peers in them
+	Subnets    []netip.Prefix
 	Peers      []PeerConfig
 	DNS        []netip.Addr
 	MTU        int
 	ListenPort *int
+	Resolver   ResolverOptions
+	// TCP tunes the TCP connections of the netstack of the device
+	TCP netstack.TCPOptions
+
+	// src locates sections and keys in the parsed file for error messages
+	src *sourceIndex
 }
 
+// Configuration describes a wireguard device and every service (proxies and
+// port forwards) that runs on top of it
 type Configuration struct {
-	Device *DeviceConfig
+	Device   *DeviceConfig
+	Routines []RoutineSpawner
+	// Hops are the tunnels the device is carried through, the first one
+	// connects from the host and every other one through the previous
+	Hops []*DeviceConfig
+	// Upstream is the proxy the tunnel connecting from the host goes through
+	Upstream *UpstreamConfig
+	// Server configures the device when it serves its peers, nil for the
+	// defaults
+	Server *ServerConfig
 }
 
 var (
@@ -44,8 +68,8 @@ var (
 )
 
 func parseString(section *ini.Section, keyName string) (string, error) {
-	key := section.Key(strings.ToLower(keyName))
-	if key == nil {
+	key, err := section.GetKey(keyName)
+	if err != nil || key.String() == "" {
 		return "", errors.New(keyName + " should not be empty")
 	}
 	return key.String(), nil
@@ -97,27 +121,33 @@ func parseNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
 	return ips, nil
 }
 
-func parseCIDRNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
-	key := section.Key(keyName)
-	if key == nil {
-		return []netip.Addr{}, nil
+func parseCIDRNetIP(section *ini.Section, keyName string) ([]netip.Addr, []netip.Prefix, error) {
+	prefixes, err := parsePrefixes(section, keyName)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var ips []netip.Addr
-	for _, str := range key.StringsWithShadows(",") {
-		prefix, err := netip.ParsePrefix(str)
-		if err != nil {
-			return nil, err
-		}
-
-		addr := prefix.Addr()
-		ips = append(ips, addr)
+	ips := []netip.Addr{}
+	subnets := []netip.Prefix{}
+	for _, prefix := range prefixes {
+		ips = append(ips, prefix.Addr())
+		subnets = append(subnets, prefix.Masked())
 	}
-	return ips, nil
+	return ips, subnets, nil
 }
 
+// parseAllowedIPs parses the AllowedIPs of a peer, clearing their host bits
+// as the device does, so the config runs the same when it is reloaded
 func parseAllowedIPs(section *ini.Section) ([]netip.Prefix, error) {
-	key := section.Key("AllowedIPs")
+	prefixes, err := parsePrefixes(section, "AllowedIPs")
+	for i := range prefixes {
+		prefixes[i] = prefixes[i].Masked()
+	}
+	return prefixes, err
+}
+
+func parsePrefixes(section *ini.Section, keyName string) ([]netip.Prefix, error) {
+	key := section.Key(keyName)
 	if key == nil {
 		return []netip.Prefix{}, nil
 	}
@@ -178,33 +208,35 @@ func ResolveIPPAndPort(addr string) (string, error) {
 func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	sections, err := cfg.SectionsByName("Interface")
 	if len(sections) != 1 || err != nil {
-		return errors.New("one and only one [Interface] is expected")
+		return &ConfigError{Section: "Interface", Err: errors.New("one and only one [Interface] is expected")}
 	}
 	section := sections[0]
 
-	address, err := parseCIDRNetIP(section, "Address")
+	var errs ConfigErrors
+
+	address, subnets, err := parseCIDRNetIP(section, "Address")
 	if err != nil {
-		return err
+		errs.add("Interface", 0, "Address", err)
 	}
-
 	device.Endpoint = address
+	device.Subnets = subnets
 
 	privKey, err := parseBase64KeyToHex(section, "PrivateKey")
 	if err != nil {
-		return err
+		errs.add("Interface", 0, "PrivateKey", err)
 	}
 	device.SecretKey = privKey
 
 	dns, err := parseNetIP(section, "DNS")
 	if err != nil {
-		return err
+		errs.add("Interface", 0, "DNS", err)
 	}
 	device.DNS = dns
 
 	if sectionKey, err := section.GetKey("MTU"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return err
+			errs.add("Interface", 0, "MTU", err)
 		}
 		device.MTU = value
 	}
@@ -212,22 +244,24 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	if sectionKey, err := section.GetKey("ListenPort"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return err
+			errs.add("Interface", 0, "ListenPort", err)
 		}
 		device.ListenPort = &value
 	}
 
-	return nil
+	return errs.err()
 }
 
 // ParsePeers parses the [Peer] section and extract the information into `peers`
 func ParsePeers(cfg *ini.File, peers *[]PeerConfig, endpoint string) error {
 	sections, err := cfg.SectionsByName("Peer")
 	if len(sections) < 1 || err != nil {
-		return errors.New("at least one [Peer] is expected")
+		return &ConfigError{Section: "Peer", Err: errors.New("at least one [Peer] is expected")}
 	}
 
-	for _, section := range sections {
+	var errs ConfigErrors
+
+	for i, section := range sections {
 		peer := PeerConfig{
 			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
 			KeepAlive:    0,
@@ -235,87 +269,534 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig, endpoint string) error {
 
 		decoded, err := parseBase64KeyToHex(section, "PublicKey")
 		if err != nil {
-			return err
+			errs.add("Peer", i, "PublicKey", err)
 		}
 		peer.PublicKey = decoded
 
 		if sectionKey, err := section.GetKey("PreSharedKey"); err == nil {
 			value, err := encodeBase64ToHex(sectionKey.String())
 			if err != nil {
-				return err
+				errs.add("Peer", i, "PreSharedKey", err)
+			} else {
+				peer.PreSharedKey = value
 			}
-			peer.PreSharedKey = value
 		}
 
 		if sectionKey, err := section.GetKey("Endpoint"); err == nil {
 			value := sectionKey.String()
 			if endpoint != "notset" {
 				peer.Endpoint = &endpoint
+			} else if _, _, err := net.SplitHostPort(value); err != nil {
+				errs.add("Peer", i, "Endpoint", err)
 			} else {
-				decoded, err = ResolveIPPAndPort(strings.ToLower(value))
-				if err != nil {
-					return err
-				}
-				peer.Endpoint = &decoded
+				// hostnames are kept so they can be resolved again later
+				peer.Endpoint = &value
 			}
 		}
 
 		if sectionKey, err := section.GetKey("PersistentKeepalive"); err == nil {
 			value, err := sectionKey.Int()
 			if err != nil {
-				return err
+				errs.add("Peer", i, "PersistentKeepalive", err)
 			}
 			peer.KeepAlive = value
 		}
 
 		peer.AllowedIPs, err = parseAllowedIPs(section)
 		if err != nil {
-			return err
+			errs.add("Peer", i, "AllowedIPs", err)
 		}
 
 		*peers = append(*peers, peer)
 	}
+	return errs.err()
+}
+
+// parseResolverConfig parses the optional [Resolver] section into `opts`
+func parseResolverConfig(cfg *ini.File, opts *ResolverOptions) error {
+	section, err := cfg.GetSection("Resolver")
+	if err != nil {
+		return nil
+	}
+
+	var errs ConfigErrors
+	if key, err := section.GetKey("Interval"); err == nil {
+		value, err := key.Int()
+		if err != nil || value < 0 {
+			errs.add("Resolver", 0, "Interval", errors.New("should be a number of seconds"))
+		}
+		opts.Interval = time.Duration(value) * time.Second
+	}
+	if key, err := section.GetKey("FailureThreshold"); err == nil {
+		value, err := key.Int()
+		if err != nil || value < 0 {
+			errs.add("Resolver", 0, "FailureThreshold", errors.New("should be a number of handshakes"))
+		}
+		opts.FailureThreshold = value
+	}
+	if key, err := section.GetKey("Prefer"); err == nil {
+		opts.Prefer = strings.ToLower(key.String())
+		if opts.Prefer != "ipv4" && opts.Prefer != "ipv6" {
+			errs.add("Resolver", 0, "Prefer", fmt.Errorf("%q should be ipv4 or ipv6", key.String()))
+		}
+	}
+	if key, err := section.GetKey("DoH"); err == nil {
+		opts.DoH = key.String()
+		if !strings.HasPrefix(opts.DoH, "https://") {
+			errs.add("Resolver", 0, "DoH", fmt.Errorf("%q should be an https:// URL", opts.DoH))
+		}
+	}
+	return errs.err()
+}
+
+// parseTCPConfig parses the optional [TCP] section into `opts`
+func parseTCPConfig(cfg *ini.File, opts *netstack.TCPOptions) error {
+	section, err := cfg.GetSection("TCP")
+	if err != nil {
+		return nil
+	}
+
+	var errs ConfigErrors
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"ReceiveBuffer", &opts.ReceiveBufferSize},
+		{"MaxReceiveBuffer", &opts.MaxReceiveBufferSize},
+		{"SendBuffer", &opts.SendBufferSize},
+		{"MaxSendBuffer", &opts.MaxSendBufferSize},
+		{"KeepaliveCount", &opts.KeepaliveCount},
+	}
+	for _, option := range ints {
+		if key, err := section.GetKey(option.name); err == nil {
+			if *option.value, err = key.Int(); err != nil || *option.value < 0 {
+				errs.add("TCP", 0, option.name, errors.New("should be a positive number"))
+			}
+		}
+	}
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"KeepaliveIdle", &opts.KeepaliveIdle},
+		{"KeepaliveInterval", &opts.KeepaliveInterval},
+	}
+	for _, option := range durations {
+		if key, err := section.GetKey(option.name); err == nil {
+			value, err := key.Int()
+			if err != nil || value < 0 {
+				errs.add("TCP", 0, option.name, errors.New("should be a number of seconds"))
+			}
+			*option.value = time.Duration(value) * time.Second
+		}
+	}
+	bools := []struct {
+		name  string
+		value *bool
+	}{
+		{"ModerateReceiveBuffer", &opts.ModerateReceiveBuffer},
+		{"SACK", &opts.SACK},
+		{"NoDelay", &opts.NoDelay},
+		{"QuickAck", &opts.QuickAck},
+	}
+	for _, option := range bools {
+		if key, err := section.GetKey(option.name); err == nil {
+			if *option.value, err = key.Bool(); err != nil {
+				errs.add("TCP", 0, option.name, errors.New("should be true or false"))
+			}
+		}
+	}
+	if key, err := section.GetKey("CongestionControl"); err == nil {
+		opts.CongestionControl = strings.ToLower(key.String())
+	}
+
+	if errs.err() == nil {
+		if err := opts.Validate(); err != nil {
+			errs.add("TCP", 0, "", err)
+		}
+	}
+	return errs.err()
+}
+
+// parseHopsConfig parses every [Hop] section, in order, into `hops`. Relative
+// paths are relative to dir.
+func parseHopsConfig(cfg *ini.File, dir string, hops *[]*DeviceConfig) error {
+	sections, err := cfg.SectionsByName("Hop")
+	if err != nil {
+		return nil
+	}
+
+	var errs ConfigErrors
+	for i, section := range sections {
+		hop, err := parseHopConfig(section, i, dir)
+		if err != nil {
+			errs.merge(err, nil)
+			continue
+		}
+		*hops = append(*hops, hop)
+	}
+	return errs.err()
+}
+
+// parseHopConfig parses the WireGuard config named by WGConfig in the index-th
+// [Hop] and applies the Endpoint, MTU and PersistentKeepalive of the section
+func parseHopConfig(section *ini.Section, index int, dir string) (*DeviceConfig, error) {
+	var errs ConfigErrors
+	path, err := parseString(section, "WGConfig")
+	if err != nil {
+		errs.add("Hop", index, "WGConfig", err)
+		return nil, errs
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errs.add("Hop", index, "WGConfig", err)
+		return nil, errs
+	}
+	cfg, err := ini.LoadSources(iniOpt, data)
+	if err != nil {
+		errs.add("Hop", index, "WGConfig", fmt.Errorf("%s: %w", path, err))
+		return nil, errs
+	}
+
+	hop := &DeviceConfig{
+		MTU:      1420,
+		Resolver: DefaultResolverOptions,
+		TCP:      netstack.DefaultTCPOptions(),
+		src:      newSourceIndex(path, data),
+	}
+	var hopErrs ConfigErrors
+	hopErrs.merge(ParseInterface(cfg, hop), hop.src)
+	hopErrs.merge(ParsePeers(cfg, &hop.Peers, "notset"), hop.src)
+	if err := hopErrs.err(); err != nil {
+		return nil, err
+	}
+
+	if key, err := section.GetKey("Endpoint"); err == nil {
+		endpoint := key.String()
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			errs.add("Hop", index, "Endpoint", err)
+		}
+		for i := range hop.Peers {
+			hop.Peers[i].Endpoint = &endpoint
+		}
+	}
+	if key, err := section.GetKey("MTU"); err == nil {
+		value, err := key.Int()
+		if err != nil {
+			errs.add("Hop", index, "MTU", err)
+		}
+		hop.MTU = value
+	}
+	if key, err := section.GetKey("PersistentKeepalive"); err == nil {
+		value, err := key.Int()
+		if err != nil {
+			errs.add("Hop", index, "PersistentKeepalive", err)
+		}
+		for i := range hop.Peers {
+			hop.Peers[i].KeepAlive = value
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return hop, nil
+}
+
+// parseServerConfig parses the optional [Server] section into `server`.
+// Relative paths are relative to dir.
+func parseServerConfig(cfg *ini.File, dir string, server **ServerConfig) error {
+	section, err := cfg.GetSection("Server")
+	if err != nil {
+		return nil
+	}
+
+	conf := DefaultServerConfig()
+	var errs ConfigErrors
+	if key, err := section.GetKey("Egress"); err == nil {
+		conf.Egress = key.String()
+		switch strings.ToLower(conf.Egress) {
+		case "":
+			errs.add("Server", 0, "Egress", errors.New("should be direct, warp or the path of a config"))
+		case EgressDirect, EgressWarp:
+			conf.Egress = strings.ToLower(conf.Egress)
+		default:
+			if !filepath.IsAbs(conf.Egress) {
+				conf.Egress = filepath.Join(dir, conf.Egress)
+			}
+		}
+	}
+	if key, err := section.GetKey("MaxConnections"); err == nil {
+		value, err := key.Int()
+		if err != nil || value < 0 {
+			errs.add("Server", 0, "MaxConnections", errors.New("should be a number of connections, 0 for no limit"))
+		}
+		conf.MaxConnections = value
+	}
+	if key, err := section.GetKey("UDPTimeout"); err == nil {
+		value, err := key.Int()
+		if err != nil || value <= 0 {
+			errs.add("Server", 0, "UDPTimeout", errors.New("should be a positive number of seconds"))
+		}
+		conf.UDPTimeout = time.Duration(value) * time.Second
+	}
+	if key, err := section.GetKey("AllowPrivate"); err == nil {
+		value, err := key.Bool()
+		if err != nil {
+			errs.add("Server", 0, "AllowPrivate", err)
+		}
+		conf.AllowPrivate = value
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	*server = &conf
 	return nil
 }
 
+// parseUpstreamConfig parses the optional [Upstream] section into `upstream`
+func parseUpstreamConfig(cfg *ini.File, upstream **UpstreamConfig) error {
+	section, err := cfg.GetSection("Upstream")
+	if err != nil {
+		return nil
+	}
+
+	var errs ConfigErrors
+	config := &UpstreamConfig{}
+	if section.HasKey("Relay") {
+		config.Relay, _ = parseString(section, "Relay")
+		if _, err := parseRelayURL(config.Relay); err != nil {
+			errs.add("Upstream", 0, "Relay", err)
+		}
+		if key, err := section.GetKey("Insecure"); err == nil {
+			if config.Insecure, err = key.Bool(); err != nil {
+				errs.add("Upstream", 0, "Insecure", err)
+			}
+		}
+		*upstream = config
+		return errs.err()
+	}
+	config.Socks5, err = parseString(section, "Socks5")
+	if err != nil {
+		errs.add("Upstream", 0, "Socks5", err)
+	} else if _, _, err := net.SplitHostPort(config.Socks5); err != nil {
+		errs.add("Upstream", 0, "Socks5", err)
+	}
+	config.Username, _ = parseString(section, "Username")
+	config.Password, _ = parseString(section, "Password")
+	*upstream = config
+	return errs.err()
+}
+
+func parseSocks5Config(section *ini.Section) (RoutineSpawner, error) {
+	config := &Socks5Config{}
+	var err error
+	config.BindAddress, err = parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.Username, _ = parseString(section, "Username")
+	config.Password, _ = parseString(section, "Password")
+
+	return config, nil
+}
+
+func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &HTTPConfig{}
+	var err error
+	config.BindAddress, err = parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.Username, _ = parseString(section, "Username")
+	config.Password, _ = parseString(section, "Password")
+
+	return config, nil
+}
+
+func parseTCPClientTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &TCPClientTunnelConfig{}
+	bindAddress, err := parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.BindAddress, err = net.ResolveTCPAddr("tcp", bindAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Target, err = parseString(section, "Target")
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseTCPServerTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &TCPServerTunnelConfig{}
+	listenPort, err := section.Key("ListenPort").Int()
+	if err != nil {
+		return nil, err
+	}
+	if listenPort < 1 || listenPort > 65535 {
+		return nil, errors.New("ListenPort should be between 1 and 65535")
+	}
+	config.ListenPort = listenPort
+
+	config.Target, err = parseString(section, "Target")
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseUDPProxyTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &UDPProxyTunnelConfig{
+		InactivityTimeout: 60,
+	}
+	bindAddress, err := parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.BindAddress, err = net.ResolveUDPAddr("udp", bindAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Target, err = parseString(section, "Target")
+	if err != nil {
+		return nil, err
+	}
+
+	if sectionKey, err := section.GetKey("InactivityTimeout"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return nil, err
+		}
+		config.InactivityTimeout = value
+	}
+
+	return config, nil
+}
+
+// parseRoutinesConfig parses every section named sectionName with f and appends the result to `routines`
+func parseRoutinesConfig(routines *[]RoutineSpawner, cfg *ini.File, sectionName string, f func(*ini.Section) (RoutineSpawner, error)) error {
+	sections, err := cfg.SectionsByName(sectionName)
+	if err != nil {
+		return nil
+	}
+
+	var errs ConfigErrors
+	for i, section := range sections {
+		routine, err := f(section)
+		if err != nil {
+			errs.add(sectionName, i, "", err)
+			continue
+		}
+		*routines = append(*routines, routine)
+	}
+
+	return errs.err()
+}
+
+var iniOpt = ini.LoadOptions{
+	Insensitive:            true,
+	AllowShadows:           true,
+	AllowNonUniqueSections: true,
+}
+
 // ParseConfig takes the path of a configuration file and parses it into Configuration
 func ParseConfig(path string, endpoint string) (*Configuration, error) {
-	iniOpt := ini.LoadOptions{
-		Insensitive:            true,
-		AllowShadows:           true,
-		AllowNonUniqueSections: true,
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
+	return parseConfigData(data, endpoint, filepath.Dir(path))
+}
+
+// ParseConfigFromReader parses the configuration read from r into Configuration
+func ParseConfigFromReader(r io.Reader, endpoint string) (*Configuration, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigData(data, endpoint, "")
+}
+
+// ParseConfigString parses the configuration in s into Configuration
+func ParseConfigString(s string, endpoint string) (*Configuration, error) {
+	return parseConfigData([]byte(s), endpoint, "")
+}
 
-	cfg, err := ini.LoadSources(iniOpt, path)
+func parseConfigData(data []byte, endpoint, dir string) (*Configuration, error) {
+	cfg, err := ini.LoadSources(iniOpt, data)
 	if err != nil {
 		return nil, err
 	}
 
 	device := &DeviceConfig{
-		MTU: 1420,
+		MTU:      1420,
+		Resolver: DefaultResolverOptions,
+		TCP:      netstack.DefaultTCPOptions(),
+		src:      newSourceIndex("", data),
 	}
 
 	root := cfg.Section("")
 	wgConf, err := root.GetKey("WGConfig")
 	wgCfg := cfg
 	if err == nil {
-		wgCfg, err = ini.LoadSources(iniOpt, wgConf.String())
+		path := wgConf.String()
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		wgData, err := os.ReadFile(path)
 		if err != nil {
 			return nil, err
 		}
+		wgCfg, err = ini.LoadSources(iniOpt, wgData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		device.src = newSourceIndex(path, wgData)
 	}
 
-	err = ParseInterface(wgCfg, device)
-	if err != nil {
-		return nil, err
-	}
+	var errs ConfigErrors
 
-	err = ParsePeers(wgCfg, &device.Peers, endpoint)
-	if err != nil {
+	errs.merge(ParseInterface(wgCfg, device), device.src)
+	errs.merge(ParsePeers(wgCfg, &device.Peers, endpoint), device.src)
+
+	var routines []RoutineSpawner
+	src := newSourceIndex("", data)
+
+	errs.merge(parseResolverConfig(cfg, &device.Resolver), src)
+	errs.merge(parseTCPConfig(cfg, &device.TCP), src)
+
+	var hops []*DeviceConfig
+	errs.merge(parseHopsConfig(cfg, dir, &hops), src)
+	var upstream *UpstreamConfig
+	errs.merge(parseUpstreamConfig(cfg, &upstream), src)
+	var server *ServerConfig
+	errs.merge(parseServerConfig(cfg, dir, &server), src)
+
+	errs.merge(parseRoutinesConfig(&routines, cfg, "Socks5", parseSocks5Config), src)
+	errs.merge(parseRoutinesConfig(&routines, cfg, "http", parseHTTPConfig), src)
+	errs.merge(parseRoutinesConfig(&routines, cfg, "TCPClientTunnel", parseTCPClientTunnelConfig), src)
+	errs.merge(parseRoutinesConfig(&routines, cfg, "TCPServerTunnel", parseTCPServerTunnelConfig), src)
+	errs.merge(parseRoutinesConfig(&routines, cfg, "UDPProxyTunnel", parseUDPProxyTunnelConfig), src)
+
+	if err := errs.err(); err != nil {
 		return nil, err
 	}
 
 	return &Configuration{
-		Device: device,
+		Device:   device,
+		Routines: routines,
+		Hops:     hops,
+		Upstream: upstream,
+		Server:   server,
 	}, nil
 }
@@ -0,0 +1,183 @@
+package wiresocks
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/tun/netstack"
+)
+
+const testConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.0.0.2/32, fd00::2/128
+DNS = 9.9.9.9
+MTU = 1280
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = /UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 127.0.0.1:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.0.0.3/32
+`
+
+func TestConfigRoundTrip(t *testing.T) {
+	conf, err := ParseConfigString(testConfig, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Device.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Marshal(conf.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := ParseConfigFromReader(strings.NewReader(string(data)), "notset")
+	if err != nil {
+		t.Fatalf("unable to parse marshalled config: %v\n%s", err, data)
+	}
+	conf.Device.src, again.Device.src = nil, nil
+	if !reflect.DeepEqual(conf.Device, again.Device) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", conf.Device, again.Device)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	config := strings.Replace(testConfig, "MTU = 1280", "MTU = 100", 1)
+	config = strings.Replace(config, "AllowedIPs = 10.0.0.3/32", "AllowedIPs = 10.0.0.3/24", 1)
+	config = strings.Replace(config, "PersistentKeepalive = 25", "PersistentKeepalive = soon", 1)
+
+	_, err := ParseConfigString(config, "notset")
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("expected one parse error, got %v", err)
+	}
+	if errs[0].Line != 12 || errs[0].Key != "PersistentKeepalive" {
+		t.Errorf("unexpected location of parse error: %v", errs[0])
+	}
+
+	config = strings.Replace(config, "PersistentKeepalive = soon", "PersistentKeepalive = 25", 1)
+	conf, err := ParseConfigString(config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// host bits are cleared when parsing, as the device would
+	if allowed := conf.Device.Peers[1].AllowedIPs; len(allowed) != 1 || allowed[0] != netip.MustParsePrefix("10.0.0.0/24") {
+		t.Errorf("parsed AllowedIPs %v", allowed)
+	}
+	// but a config built otherwise is still checked for them
+	conf.Device.Peers[1].AllowedIPs = []netip.Prefix{netip.MustParsePrefix("10.0.0.3/24")}
+	err = conf.Device.Validate()
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected two validation errors, got %v", err)
+	}
+	if errs[0].Line != 5 || errs[0].Key != "MTU" {
+		t.Errorf("unexpected location of MTU error: %v", errs[0])
+	}
+	if errs[1].Line != 16 || errs[1].Index != 1 {
+		t.Errorf("unexpected location of AllowedIPs error: %v", errs[1])
+	}
+}
+
+func TestConfigResolver(t *testing.T) {
+	config := strings.Replace(testConfig, "Endpoint = 127.0.0.1:51820", "Endpoint = vpn.example.com:51820", 1)
+	config += "\n[Resolver]\nInterval = 60\nPrefer = IPv6\nDoH = https://1.1.1.1/dns-query\n"
+
+	conf, err := ParseConfigString(config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *conf.Device.Peers[0].Endpoint != "vpn.example.com:51820" {
+		t.Errorf("hostname endpoint was not kept: %s", *conf.Device.Peers[0].Endpoint)
+	}
+	expected := ResolverOptions{
+		Interval:         time.Minute,
+		FailureThreshold: DefaultResolverOptions.FailureThreshold,
+		Prefer:           "ipv6",
+		DoH:              "https://1.1.1.1/dns-query",
+	}
+	if conf.Device.Resolver != expected {
+		t.Errorf("unexpected resolver options %+v", conf.Device.Resolver)
+	}
+
+	_, err = ParseConfigString(strings.Replace(config, "Prefer = IPv6", "Prefer = both", 1), "notset")
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Key != "Prefer" {
+		t.Errorf("expected an error about Prefer, got %v", err)
+	}
+}
+
+func TestConfigTCP(t *testing.T) {
+	config := testConfig + "\n[TCP]\nMaxReceiveBuffer = 16777216\nCongestionControl = Reno\nKeepaliveIdle = 30\nQuickAck = true\n"
+
+	conf, err := ParseConfigString(config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := netstack.DefaultTCPOptions()
+	expected.MaxReceiveBufferSize = 16 << 20
+	expected.CongestionControl = "reno"
+	expected.KeepaliveIdle = 30 * time.Second
+	expected.QuickAck = true
+	if conf.Device.TCP != expected {
+		t.Errorf("unexpected TCP options %+v", conf.Device.TCP)
+	}
+
+	_, err = ParseConfigString(strings.Replace(config, "Reno", "bbr", 1), "notset")
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Section != "TCP" {
+		t.Errorf("expected an error about [TCP], got %v", err)
+	}
+}
+
+func TestConfigServer(t *testing.T) {
+	config := testConfig + "\n[Server]\nEgress = exit.conf\nMaxConnections = 0\nUDPTimeout = 30\nAllowPrivate = true\n"
+
+	conf, err := ParseConfigString(config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ServerConfig{Egress: "exit.conf", UDPTimeout: 30 * time.Second, AllowPrivate: true}
+	if conf.Server == nil || *conf.Server != expected {
+		t.Errorf("unexpected server config %+v", conf.Server)
+	}
+
+	_, err = ParseConfigString(strings.Replace(config, "UDPTimeout = 30", "UDPTimeout = 0", 1), "notset")
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Section != "Server" || errs[0].Key != "UDPTimeout" {
+		t.Errorf("expected an error about UDPTimeout, got %v", err)
+	}
+}
+
+func TestConfigWGConfigRelative(t *testing.T) {
+	// the include is next to the config, not in the working directory
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "wg.conf"), []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "wiresocks.conf")
+	if err := os.WriteFile(path, []byte("WGConfig = wg.conf\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ParseConfig(path, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Device.Peers) != 2 || conf.Device.MTU != 1280 {
+		t.Errorf("unexpected device %+v", conf.Device)
+	}
+}
@@ -0,0 +1,466 @@
+package wiresocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+)
+
+// The HTTP relay carries the same frames as the stream relays in the bodies
+// of plain requests, for networks which only let HTTP(S) out. Every request
+// names the session of the client in a header. A POST sends the frames of its
+// body, a GET waits for replies and returns them, and a DELETE ends the
+// session. Sessions are created by their first request.
+
+const (
+	httpRelaySessionHeader = "X-Relay-Session"
+	// httpRelayPollTimeout is how long a GET waits for a reply, short enough
+	// for the proxies in between not to give up on the request
+	httpRelayPollTimeout = 20 * time.Second
+	// httpRelayPollers is the number of GETs a client keeps waiting, so one
+	// is always there while the replies of another travel back
+	httpRelayPollers = 2
+	// httpRelayQueueSize is the number of datagrams waiting for a request,
+	// more are dropped
+	httpRelayQueueSize = 256
+	httpRelayMaxBody   = 1 << 20
+	// DefaultMaxHTTPSessions is the number of HTTP relay sessions open at
+	// once when RelayServer.MaxHTTPSessions is zero
+	DefaultMaxHTTPSessions = 1024
+)
+
+var (
+	errHTTPSessionDeleted = errors.New("relay session was deleted by its client")
+	errHTTPSessionsFull   = errors.New("too many relay sessions")
+)
+
+// httpRelaySession is the UDP socket of an HTTP relay client and the replies
+// waiting for its next GET
+type httpRelaySession struct {
+	udp      *net.UDPConn
+	replies  chan relayPacket
+	lastSeen atomic.Int64 // unix nanoseconds of the last request
+}
+
+func (session *httpRelaySession) touch() {
+	session.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (session *httpRelaySession) idle() time.Duration {
+	return time.Since(time.Unix(0, session.lastSeen.Load()))
+}
+
+// validSessionID reports whether id is the hex of 16 bytes
+func validSessionID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// HTTPHandler returns a handler serving relay clients over HTTP
+func (s *RelayServer) HTTPHandler() http.Handler {
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+func (s *RelayServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(httpRelaySessionHeader)
+	if !validSessionID(id) {
+		http.Error(w, "missing or invalid session", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		session, err := s.httpSession(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		body := bufio.NewReader(http.MaxBytesReader(w, r.Body, httpRelayMaxBody))
+		buf := make([]byte, 0xffff+2)
+		for {
+			addr, payload, err := readRelayFrame(body, buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if s.allowed(addr) {
+				_, _ = session.udp.WriteToUDPAddrPort(payload, addr)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		session, err := s.httpSession(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		s.pollHTTPSession(w, r, session)
+	case http.MethodDelete:
+		s.httpMu.Lock()
+		session := s.httpSessions[id]
+		s.deleteHTTPSession(id)
+		s.httpMu.Unlock()
+		if session != nil {
+			// its reader removes it
+			_ = session.udp.Close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// httpSession returns the session id, creating it when it is new
+func (s *RelayServer) httpSession(id string) (*httpRelaySession, error) {
+	s.httpMu.Lock()
+	defer s.httpMu.Unlock()
+	if session, ok := s.httpSessions[id]; ok {
+		session.touch()
+		return session, nil
+	}
+	if _, ok := s.httpDeleted[id]; ok {
+		return nil, errHTTPSessionDeleted
+	}
+	maxSessions := s.MaxHTTPSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultMaxHTTPSessions
+	}
+	if len(s.httpSessions) >= maxSessions {
+		return nil, errHTTPSessionsFull
+	}
+
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	session := &httpRelaySession{udp: udp, replies: make(chan relayPacket, httpRelayQueueSize)}
+	session.touch()
+	if s.httpSessions == nil {
+		s.httpSessions = make(map[string]*httpRelaySession)
+	}
+	s.httpSessions[id] = session
+	go s.readHTTPSession(id, session)
+	return session, nil
+}
+
+// deleteHTTPSession records that the client ended session id, forgetting
+// the sessions deleted longer than relayIdleTimeout ago. s.httpMu is held.
+func (s *RelayServer) deleteHTTPSession(id string) {
+	now := time.Now()
+	for deleted, at := range s.httpDeleted {
+		if now.Sub(at) > relayIdleTimeout {
+			delete(s.httpDeleted, deleted)
+		}
+	}
+	if s.httpDeleted == nil {
+		s.httpDeleted = make(map[string]time.Time)
+	}
+	s.httpDeleted[id] = now
+}
+
+// readHTTPSession queues the replies of the session until it is closed or
+// has seen no request for relayIdleTimeout
+func (s *RelayServer) readHTTPSession(id string, session *httpRelaySession) {
+	defer func() {
+		s.httpMu.Lock()
+		if s.httpSessions[id] == session {
+			delete(s.httpSessions, id)
+		}
+		s.httpMu.Unlock()
+		_ = session.udp.Close()
+	}()
+
+	buf := make([]byte, 0xffff)
+	for {
+		_ = session.udp.SetReadDeadline(time.Now().Add(httpRelayPollTimeout))
+		n, from, err := session.udp.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && session.idle() < relayIdleTimeout {
+				continue
+			}
+			return
+		}
+		packet := relayPacket{
+			addr:    netip.AddrPortFrom(from.Addr().Unmap(), from.Port()),
+			payload: append([]byte(nil), buf[:n]...),
+		}
+		select {
+		case session.replies <- packet:
+		default:
+			// the client does not keep up, drop like a congested link would
+		}
+	}
+}
+
+// pollHTTPSession answers with the replies queued for session, waiting up to
+// httpRelayPollTimeout for the first of them
+func (s *RelayServer) pollHTTPSession(w http.ResponseWriter, r *http.Request, session *httpRelaySession) {
+	timer := time.NewTimer(httpRelayPollTimeout)
+	defer timer.Stop()
+
+	var body bytes.Buffer
+	select {
+	case packet := <-session.replies:
+		_ = writeRelayFrame(&body, packet.addr, packet.payload)
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
+drain:
+	for body.Len() < httpRelayMaxBody/2 {
+		select {
+		case packet := <-session.replies:
+			_ = writeRelayFrame(&body, packet.addr, packet.payload)
+		default:
+			break drain
+		}
+	}
+
+	session.touch()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(body.Bytes())
+}
+
+// HTTPRelayBind is a conn.Bind which sends the WireGuard datagrams to an HTTP
+// relay in POST requests and long polls it for the replies.
+type HTTPRelayBind struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	session  string
+	cancel   context.CancelFunc
+	done     chan struct{} // closed by Close, nil while the bind is not open
+	incoming chan relayPacket
+	outgoing chan []byte // frames waiting for a POST
+}
+
+var _ conn.Bind = (*HTTPRelayBind)(nil)
+
+// NewHTTPRelayBind returns a bind which goes through the relay at the http://
+// or https:// URL relay. tlsConfig may be nil.
+func NewHTTPRelayBind(relay string, tlsConfig *tls.Config) (*HTTPRelayBind, error) {
+	u, err := parseRelayURL(relay)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported HTTP relay scheme %q, expected http or https", u.Scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = httpRelayPollers + 1
+	return &HTTPRelayBind{url: u.String(), client: &http.Client{Transport: transport}}, nil
+}
+
+func (b *HTTPRelayBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, 0, err
+	}
+	b.session = hex.EncodeToString(id)
+
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	b.done = make(chan struct{})
+	b.incoming = make(chan relayPacket, httpRelayQueueSize)
+	b.outgoing = make(chan []byte, httpRelayQueueSize)
+	for i := 0; i < httpRelayPollers; i++ {
+		go b.poll(ctx, b.session, b.incoming)
+	}
+	go b.post(ctx, b.session, b.outgoing)
+
+	// there is no local port, report the requested one
+	return []conn.ReceiveFunc{relayReceiveFunc(b.done, b.incoming)}, port, nil
+}
+
+// request sends a request of session to the relay
+func (b *HTTPRelayBind) request(ctx context.Context, method, session string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(httpRelaySessionHeader, session)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("relay answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// post sends the queued frames, as many at once as are waiting
+func (b *HTTPRelayBind) post(ctx context.Context, session string, outgoing chan []byte) {
+	for {
+		var body []byte
+		select {
+		case frame := <-outgoing:
+			body = frame
+		case <-ctx.Done():
+			return
+		}
+	drain:
+		for len(body) < httpRelayMaxBody/2 {
+			select {
+			case frame := <-outgoing:
+				body = append(body, frame...)
+			default:
+				break drain
+			}
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, relayDialTimeout)
+		resp, err := b.request(reqCtx, http.MethodPost, session, body)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("http relay %s: unable to send: %v", b.url, err)
+			}
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// poll waits for the replies of the relay until ctx is done, backing off
+// while the relay cannot be reached
+func (b *HTTPRelayBind) poll(ctx context.Context, session string, incoming chan relayPacket) {
+	backoff := time.Second
+	buf := make([]byte, 0xffff+2)
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, httpRelayPollTimeout+relayDialTimeout)
+		resp, err := b.request(reqCtx, http.MethodGet, session, nil)
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("http relay %s: unable to poll: %v", b.url, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > relayMaxBackoff {
+				backoff = relayMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		body := bufio.NewReader(resp.Body)
+		for {
+			addr, payload, err := readRelayFrame(body, buf)
+			if err != nil {
+				break
+			}
+			packet := relayPacket{addr: addr, payload: append([]byte(nil), payload...)}
+			select {
+			case incoming <- packet:
+			case <-ctx.Done():
+			}
+		}
+		resp.Body.Close()
+		cancel()
+	}
+}
+
+func (b *HTTPRelayBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done == nil {
+		return nil
+	}
+	close(b.done)
+	b.done = nil
+	b.cancel()
+
+	// let the relay free the session now rather than when it expires
+	session := b.session
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), relayDialTimeout)
+		defer cancel()
+		if resp, err := b.request(ctx, http.MethodDelete, session, nil); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	return nil
+}
+
+func (b *HTTPRelayBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *HTTPRelayBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	endpoint, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	outgoing, open := b.outgoing, b.done != nil
+	b.mu.Unlock()
+	if !open {
+		return errRelayClosed
+	}
+
+	for _, buf := range bufs {
+		var frame bytes.Buffer
+		if err := writeRelayFrame(&frame, endpoint.AddrPort, buf); err != nil {
+			return err
+		}
+		select {
+		case outgoing <- frame.Bytes():
+		default:
+			// the relay does not keep up, drop like a congested link would
+		}
+	}
+	return nil
+}
+
+func (b *HTTPRelayBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+func (b *HTTPRelayBind) BatchSize() int {
+	return 1
+}
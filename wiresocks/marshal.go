@@ -0,0 +1,90 @@
+package wiresocks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+func encodeHexToBase64(key string) (string, error) {
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid hex key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(decoded), nil
+}
+
+func isZeroKey(key string) bool {
+	return strings.Trim(key, "0") == ""
+}
+
+// Marshal serializes a device configuration into a wg-quick compatible file
+func Marshal(conf *DeviceConfig) ([]byte, error) {
+	var b bytes.Buffer
+
+	privateKey, err := encodeHexToBase64(conf.SecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("[Interface] PrivateKey: %w", err)
+	}
+
+	b.WriteString("[Interface]\n")
+	b.WriteString(fmt.Sprintf("PrivateKey = %s\n", privateKey))
+	if len(conf.Endpoint) > 0 {
+		addresses := make([]string, len(conf.Endpoint))
+		for i, addr := range conf.Endpoint {
+			bits := addr.BitLen()
+			if i < len(conf.Subnets) {
+				bits = conf.Subnets[i].Bits()
+			}
+			addresses[i] = fmt.Sprintf("%s/%d", addr, bits)
+		}
+		b.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(addresses, ", ")))
+	}
+	if len(conf.DNS) > 0 {
+		servers := make([]string, len(conf.DNS))
+		for i, addr := range conf.DNS {
+			servers[i] = addr.String()
+		}
+		b.WriteString(fmt.Sprintf("DNS = %s\n", strings.Join(servers, ", ")))
+	}
+	if conf.MTU > 0 {
+		b.WriteString(fmt.Sprintf("MTU = %d\n", conf.MTU))
+	}
+	if conf.ListenPort != nil {
+		b.WriteString(fmt.Sprintf("ListenPort = %d\n", *conf.ListenPort))
+	}
+
+	for i, peer := range conf.Peers {
+		publicKey, err := encodeHexToBase64(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("[Peer #%d] PublicKey: %w", i+1, err)
+		}
+
+		b.WriteString("\n[Peer]\n")
+		b.WriteString(fmt.Sprintf("PublicKey = %s\n", publicKey))
+		if peer.PreSharedKey != "" && !isZeroKey(peer.PreSharedKey) {
+			presharedKey, err := encodeHexToBase64(peer.PreSharedKey)
+			if err != nil {
+				return nil, fmt.Errorf("[Peer #%d] PreSharedKey: %w", i+1, err)
+			}
+			b.WriteString(fmt.Sprintf("PresharedKey = %s\n", presharedKey))
+		}
+		if len(peer.AllowedIPs) > 0 {
+			prefixes := make([]string, len(peer.AllowedIPs))
+			for i, prefix := range peer.AllowedIPs {
+				prefixes[i] = prefix.String()
+			}
+			b.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(prefixes, ", ")))
+		}
+		if peer.Endpoint != nil {
+			b.WriteString(fmt.Sprintf("Endpoint = %s\n", *peer.Endpoint))
+		}
+		if peer.KeepAlive > 0 {
+			b.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", peer.KeepAlive))
+		}
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,291 @@
+package wiresocks
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/device"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MonitorOptions controls how the quality of the endpoint is watched
+type MonitorOptions struct {
+	// Interval between two measurements
+	Interval time.Duration
+	// Alternates are the endpoints the peer may be moved to
+	Alternates []string
+	// PingTarget is pinged through the tunnel to check it carries traffic
+	PingTarget netip.Addr
+	// Window is the number of measurements an endpoint is judged on
+	Window int
+	// MaxRTT and MaxLoss are the median round trip of the pings through the
+	// tunnel and the share of failed measurements beyond which an endpoint
+	// is degraded
+	MaxRTT  time.Duration
+	MaxLoss float64
+}
+
+// DefaultMonitorOptions returns the options used with the warp endpoints
+func DefaultMonitorOptions() MonitorOptions {
+	return MonitorOptions{
+		Interval:   30 * time.Second,
+		PingTarget: netip.MustParseAddr("1.1.1.1"),
+		Window:     6,
+		MaxRTT:     time.Second,
+		MaxLoss:    0.4,
+	}
+}
+
+// endpointQuality keeps the last measurements of an endpoint
+type endpointQuality struct {
+	samples []qualitySample
+}
+
+// qualitySample is a measurement, its rtt zero when it passed untimed
+type qualitySample struct {
+	rtt time.Duration
+	ok  bool
+}
+
+func (q *endpointQuality) add(rtt time.Duration, ok bool, window int) {
+	if !ok {
+		rtt = 0
+	}
+	q.samples = append(q.samples, qualitySample{rtt: rtt, ok: ok})
+	if len(q.samples) > window {
+		q.samples = q.samples[len(q.samples)-window:]
+	}
+}
+
+func (q *endpointQuality) loss() float64 {
+	if len(q.samples) == 0 {
+		return 1
+	}
+	failed := 0
+	for _, sample := range q.samples {
+		if !sample.ok {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(q.samples))
+}
+
+func (q *endpointQuality) median() time.Duration {
+	var timed []time.Duration
+	for _, sample := range q.samples {
+		if sample.rtt != 0 {
+			timed = append(timed, sample.rtt)
+		}
+	}
+	if len(timed) == 0 {
+		return 0
+	}
+	sort.Slice(timed, func(i, j int) bool { return timed[i] < timed[j] })
+	return timed[len(timed)/2]
+}
+
+// degraded reports whether enough measurements show the endpoint is lossy or slow
+func (q *endpointQuality) degraded(opts *MonitorOptions) bool {
+	if len(q.samples) < (opts.Window+1)/2 {
+		return false
+	}
+	return q.loss() > opts.MaxLoss || q.median() > opts.MaxRTT
+}
+
+// better reports whether q is a better endpoint than other
+func (q *endpointQuality) better(other *endpointQuality) bool {
+	if q.loss() != other.loss() {
+		return q.loss() < other.loss()
+	}
+	return q.median() < other.median()
+}
+
+// MonitorEndpoint judges the endpoint of the first peer every opts.Interval
+// until the tunnel is done, from the age of its session, the traffic it
+// carries and a ping through the tunnel. A handshake with an alternate would
+// make the server roam the live session to it, so alternates are never
+// probed: once the endpoint degrades, the peer is moved to the next one of
+// opts.Alternates and that one is judged the same way. Proxied connections
+// survive a move as the tunnel addresses do not change.
+func (vt *VirtualTun) MonitorEndpoint(opts MonitorOptions) {
+	vt.confMutex.Lock()
+	var publicKey string
+	for _, peer := range vt.conf.Peers {
+		if peer.Endpoint != nil {
+			publicKey = peer.PublicKey
+			break
+		}
+	}
+	active := vt.endpoints[publicKey]
+	vt.confMutex.Unlock()
+	if publicKey == "" {
+		return
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	activeQuality := &endpointQuality{}
+	// judged keeps how the endpoints did while they were active
+	judged := make(map[string]*endpointQuality)
+	var lastRx uint64
+	for {
+		select {
+		case <-vt.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// the resolver may have moved the peer meanwhile
+		vt.confMutex.Lock()
+		if current, ok := vt.endpoints[publicKey]; ok && current != active {
+			active = current
+			activeQuality = &endpointQuality{}
+		}
+		vt.confMutex.Unlock()
+
+		rtt, ok := vt.measureTunnel(&opts, publicKey, &lastRx)
+		activeQuality.add(rtt, ok, opts.Window)
+		if !activeQuality.degraded(&opts) {
+			continue
+		}
+
+		judged[active] = activeQuality
+		next := nextEndpoint(opts.Alternates, active, judged)
+		if next == "" {
+			log.Printf("endpoint %s is degraded (loss %.0f%%, rtt %v), no better alternate",
+				active, activeQuality.loss()*100, activeQuality.median())
+			// they may have recovered by the next time it degrades
+			judged = map[string]*endpointQuality{active: activeQuality}
+			activeQuality = &endpointQuality{}
+			continue
+		}
+
+		if err := vt.moveEndpoint(publicKey, next); err != nil {
+			log.Printf("unable to move to endpoint %s: %v", next, err)
+			continue
+		}
+		log.Printf("endpoint %s is degraded (loss %.0f%%, rtt %v), moved to %s",
+			active, activeQuality.loss()*100, activeQuality.median(), next)
+		active = next
+		activeQuality = &endpointQuality{}
+	}
+}
+
+// nextEndpoint returns the alternate to move to from the degraded active
+// endpoint: the first one not judged yet, or else the best one judged when
+// it did better than active, empty when there is none
+func nextEndpoint(alternates []string, active string, judged map[string]*endpointQuality) string {
+	var best string
+	for _, alternate := range alternates {
+		if alternate == active {
+			continue
+		}
+		q, ok := judged[alternate]
+		if !ok {
+			return alternate
+		}
+		if q.better(judged[active]) && (best == "" || q.better(judged[best])) {
+			best = alternate
+		}
+	}
+	return best
+}
+
+// measureTunnel judges the active endpoint without a handshake of its own:
+// its session must be alive and the tunnel must carry traffic. It returns
+// the time the ping took, zero when it was lost.
+func (vt *VirtualTun) measureTunnel(opts *MonitorOptions, publicKey string, lastRx *uint64) (time.Duration, bool) {
+	pingRTT, pingErr := vt.pingThroughTunnel(opts.PingTarget, opts.MaxRTT*2)
+	stats, err := peerStats(vt.Dev)
+	if err != nil {
+		return 0, false
+	}
+	stat, found := stats[publicKey]
+	if !found {
+		return 0, false
+	}
+	rxGrew := stat.rxBytes > *lastRx
+	*lastRx = stat.rxBytes
+
+	// the pings make the device handshake again before its session expires,
+	// an older session means the endpoint stopped answering handshakes
+	if stat.lastHandshake.IsZero() || time.Since(stat.lastHandshake) > device.RejectAfterTime {
+		vt.Logger.Debug("monitor: no handshake with", stat.endpoint, "since", stat.lastHandshake)
+		return 0, false
+	}
+	if pingErr != nil {
+		// the ping may be filtered, rx growing still shows the tunnel
+		// answers keepalives
+		vt.Logger.Debug("monitor: ping through", stat.endpoint, "failed:", pingErr)
+		return 0, rxGrew
+	}
+	vt.Logger.Debug("monitor:", stat.endpoint, "ping", pingRTT)
+	return pingRTT, true
+}
+
+// moveEndpoint points the peer with publicKey at endpoint
+func (vt *VirtualTun) moveEndpoint(publicKey, endpoint string) error {
+	vt.confMutex.Lock()
+	defer vt.confMutex.Unlock()
+
+	err := vt.Dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", publicKey, endpoint))
+	if err != nil {
+		return err
+	}
+	vt.endpoints[publicKey] = endpoint
+	return nil
+}
+
+// pingThroughTunnel sends an ICMP echo to target through the tunnel and
+// returns the time it took to get the reply
+func (vt *VirtualTun) pingThroughTunnel(target netip.Addr, timeout time.Duration) (time.Duration, error) {
+	conn, err := vt.Tnet.DialPingAddr(netip.Addr{}, target)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	request := icmp.Echo{
+		ID:   rand.Intn(1 << 16),
+		Seq:  rand.Intn(1 << 16),
+		Data: []byte("wiresocks monitor"),
+	}
+	message := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &request}
+	protocol := 1
+	if target.Is6() {
+		message.Type = ipv6.ICMPTypeEchoRequest
+		protocol = 58
+	}
+	packet, err := message.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	start := time.Now()
+	if _, err := conn.Write(packet); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == request.Seq && bytes.Equal(echo.Data, request.Data) {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package wiresocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpointQuality(t *testing.T) {
+	opts := DefaultMonitorOptions()
+
+	var good, lossy, slow endpointQuality
+	for i := 0; i < opts.Window+2; i++ {
+		good.add(100*time.Millisecond, true, opts.Window)
+		lossy.add(100*time.Millisecond, i%2 == 0, opts.Window)
+		slow.add(2*opts.MaxRTT, true, opts.Window)
+	}
+
+	if len(good.samples) != opts.Window {
+		t.Fatalf("kept %d measurements, want %d", len(good.samples), opts.Window)
+	}
+	if good.degraded(&opts) {
+		t.Error("good endpoint is degraded")
+	}
+	if !lossy.degraded(&opts) {
+		t.Errorf("lossy endpoint with loss %v is not degraded", lossy.loss())
+	}
+	if !slow.degraded(&opts) {
+		t.Errorf("slow endpoint with median %v is not degraded", slow.median())
+	}
+	if !good.better(&lossy) || !good.better(&slow) || lossy.better(&good) {
+		t.Error("endpoints are not ordered by loss and median")
+	}
+
+	// measurements passed without a round trip only count against the loss
+	var untimed endpointQuality
+	untimed.add(0, true, opts.Window)
+	untimed.add(300*time.Millisecond, true, opts.Window)
+	untimed.add(0, true, opts.Window)
+	if untimed.loss() != 0 || untimed.median() != 300*time.Millisecond {
+		t.Errorf("untimed measurements gave loss %v, median %v", untimed.loss(), untimed.median())
+	}
+
+	// a single failure is not enough to judge an endpoint
+	var fresh endpointQuality
+	fresh.add(0, false, opts.Window)
+	if fresh.degraded(&opts) {
+		t.Error("endpoint degraded after a single measurement")
+	}
+}
+
+func TestNextEndpoint(t *testing.T) {
+	opts := DefaultMonitorOptions()
+	judge := func(rtt time.Duration, ok bool) *endpointQuality {
+		q := &endpointQuality{}
+		for i := 0; i < opts.Window; i++ {
+			q.add(rtt, ok, opts.Window)
+		}
+		return q
+	}
+	alternates := []string{"a:1", "b:1", "c:1"}
+	judged := map[string]*endpointQuality{"a:1": judge(0, false)}
+
+	// the alternates which were not active yet come first, in order
+	if next := nextEndpoint(alternates, "a:1", judged); next != "b:1" {
+		t.Errorf("moved from a to %q", next)
+	}
+	judged["b:1"] = judge(2*opts.MaxRTT, true)
+	if next := nextEndpoint(alternates, "b:1", judged); next != "c:1" {
+		t.Errorf("moved from b to %q", next)
+	}
+
+	// then the best of them, only when it did better
+	judged["c:1"] = judge(0, false)
+	if next := nextEndpoint(alternates, "c:1", judged); next != "b:1" {
+		t.Errorf("moved from c to %q", next)
+	}
+	judged["c:1"] = judge(100*time.Millisecond, true)
+	if next := nextEndpoint(alternates, "c:1", judged); next != "" {
+		t.Errorf("moved from the best endpoint to %q", next)
+	}
+}
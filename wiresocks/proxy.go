@@ -9,6 +9,7 @@ import (
 	"github.com/bepass-org/wireguard-go/tun/netstack"
 	"io"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -20,6 +21,14 @@ type VirtualTun struct {
 	Logger    DefaultLogger
 	Dev       *device.Device
 	Ctx       context.Context
+
+	// conf is the configuration the device is running with
+	conf      *DeviceConfig
+	confMutex sync.Mutex
+	// reloadMutex keeps a single Reload running, conf only changes in it
+	reloadMutex sync.Mutex
+	// endpoints are the addresses the peer endpoints resolved to
+	endpoints map[string]string
 }
 
 type DefaultLogger struct {
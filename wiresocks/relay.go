@@ -0,0 +1,475 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+	"golang.org/x/net/websocket"
+)
+
+// The relay transports carry WireGuard datagrams over a stream. Every frame
+// is a big endian uint16 length followed by the address of the peer, encoded
+// like in a socks5 datagram header, and the datagram itself. The address is
+// the destination on the way to the relay and the source on the way back.
+
+const (
+	relayDialTimeout = 10 * time.Second
+	relayMaxBackoff  = 30 * time.Second
+	// relayIdleTimeout closes the UDP socket of a relay client which has been
+	// silent for that long
+	relayIdleTimeout = 5 * time.Minute
+)
+
+var errRelayClosed = errors.New("relay bind is closed")
+
+// relayPacket is a datagram received from a relay
+type relayPacket struct {
+	addr    netip.AddrPort
+	payload []byte
+}
+
+// writeRelayFrame writes the datagram payload exchanged with addr to w
+func writeRelayFrame(w io.Writer, addr netip.AddrPort, payload []byte) error {
+	header := socks5UDPHeader(addr)[3:] // no reserved and fragment bytes
+	if len(header)+len(payload) > 0xffff {
+		return fmt.Errorf("datagram of %d bytes is too large", len(payload))
+	}
+	frame := make([]byte, 2, 2+len(header)+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(header)+len(payload)))
+	frame = append(append(frame, header...), payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readRelayFrame reads the next frame from r into buf
+func readRelayFrame(r io.Reader, buf []byte) (netip.AddrPort, []byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(buf[:2]))
+	frame := buf[:size]
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	addr, n, err := parseSocks5Addr(frame)
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	return addr, frame[n:], nil
+}
+
+// dialRelay opens a stream to the relay at u, a tcp://, tls://, ws:// or
+// wss:// URL
+func dialRelay(u *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: relayDialTimeout}
+	switch u.Scheme {
+	case "tcp":
+		return dialer.Dial("tcp", u.Host)
+	case "tls":
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		return tls.DialWithDialer(dialer, "tcp", u.Host, config)
+	case "ws", "wss":
+		origin := "http://" + u.Host
+		if u.Scheme == "wss" {
+			origin = "https://" + u.Host
+		}
+		config, err := websocket.NewConfig(u.String(), origin)
+		if err != nil {
+			return nil, err
+		}
+		config.Dialer = dialer
+		config.TlsConfig = tlsConfig
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		return ws, nil
+	default:
+		return nil, fmt.Errorf("unsupported relay scheme %q, expected tcp, tls, ws or wss", u.Scheme)
+	}
+}
+
+// parseRelayURL parses the URL of a relay
+func parseRelayURL(relay string) (*url.URL, error) {
+	u, err := url.Parse(relay)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp", "tls":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid relay address %q: %w", u.Host, err)
+		}
+	case "ws", "wss", "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("relay URL %q has no host", relay)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported relay scheme %q, expected tcp, tls, ws, wss, http or https", u.Scheme)
+	}
+	return u, nil
+}
+
+// newUpstreamRelayBind returns the bind for the relay of upstream, which
+// depends on the scheme of its URL
+func newUpstreamRelayBind(upstream *UpstreamConfig) (conn.Bind, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: upstream.Insecure}
+	if strings.HasPrefix(upstream.Relay, "http://") || strings.HasPrefix(upstream.Relay, "https://") {
+		return NewHTTPRelayBind(upstream.Relay, tlsConfig)
+	}
+	return NewRelayBind(upstream.Relay, tlsConfig)
+}
+
+// RelayBind is a conn.Bind which sends the WireGuard datagrams over a TCP,
+// TLS or WebSocket stream to a relay, which forwards them over UDP. The stream
+// is opened again whenever it drops.
+type RelayBind struct {
+	url       *url.URL
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	stream   net.Conn // nil while reconnecting
+	done     chan struct{}
+	incoming chan relayPacket
+	writeMu  sync.Mutex
+}
+
+var _ conn.Bind = (*RelayBind)(nil)
+
+// NewRelayBind returns a bind which goes through the relay at the tcp://,
+// tls://, ws:// or wss:// URL relay. tlsConfig may be nil.
+func NewRelayBind(relay string, tlsConfig *tls.Config) (*RelayBind, error) {
+	u, err := parseRelayURL(relay)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return nil, fmt.Errorf("%s relays are not streams, use an HTTPRelayBind", u.Scheme)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &RelayBind{url: u, tlsConfig: tlsConfig}, nil
+}
+
+func (b *RelayBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	stream, err := dialRelay(b.url, b.tlsConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.stream = stream
+	b.done = make(chan struct{})
+	b.incoming = make(chan relayPacket, conn.IdealBatchSize)
+	go b.maintain(stream, b.done, b.incoming)
+
+	// there is no local port, report the requested one
+	return []conn.ReceiveFunc{relayReceiveFunc(b.done, b.incoming)}, port, nil
+}
+
+// maintain reads the frames of stream and dials the relay again when it drops
+func (b *RelayBind) maintain(stream net.Conn, done chan struct{}, incoming chan relayPacket) {
+	for {
+		buf := make([]byte, 0xffff+2)
+		for {
+			addr, payload, err := readRelayFrame(stream, buf)
+			if err != nil {
+				break
+			}
+			packet := relayPacket{addr: addr, payload: append([]byte(nil), payload...)}
+			select {
+			case incoming <- packet:
+			case <-done:
+				return
+			}
+		}
+
+		b.mu.Lock()
+		if b.done != done {
+			b.mu.Unlock()
+			return
+		}
+		b.stream = nil
+		b.mu.Unlock()
+		_ = stream.Close()
+
+		backoff := time.Second
+		for {
+			var err error
+			stream, err = dialRelay(b.url, b.tlsConfig)
+			if err == nil {
+				break
+			}
+			log.Printf("relay %s: unable to connect: %v", b.url.Redacted(), err)
+			select {
+			case <-done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > relayMaxBackoff {
+				backoff = relayMaxBackoff
+			}
+		}
+
+		b.mu.Lock()
+		if b.done != done {
+			b.mu.Unlock()
+			_ = stream.Close()
+			return
+		}
+		b.stream = stream
+		b.mu.Unlock()
+		log.Printf("relay %s: connected again", b.url.Redacted())
+	}
+}
+
+// relayReceiveFunc returns the datagrams of incoming until done is closed
+func relayReceiveFunc(done chan struct{}, incoming chan relayPacket) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case packet := <-incoming:
+			sizes[0] = copy(packets[0], packet.payload)
+			eps[0] = &conn.StdNetEndpoint{AddrPort: packet.addr}
+			return 1, nil
+		case <-done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (b *RelayBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done == nil {
+		return nil
+	}
+	close(b.done)
+	b.done = nil
+	if b.stream != nil {
+		_ = b.stream.Close()
+		b.stream = nil
+	}
+	return nil
+}
+
+func (b *RelayBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *RelayBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	endpoint, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	stream, open := b.stream, b.done != nil
+	b.mu.Unlock()
+	if !open {
+		return errRelayClosed
+	}
+	if stream == nil {
+		return errors.New("relay is reconnecting")
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	for _, buf := range bufs {
+		if err := writeRelayFrame(stream, endpoint.AddrPort, buf); err != nil {
+			// the reader notices too and reconnects
+			_ = stream.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *RelayBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+func (b *RelayBind) BatchSize() int {
+	return 1
+}
+
+// RelayServer forwards the datagrams framed on the streams or in the HTTP
+// requests of its clients over UDP and frames the replies back. Every client
+// gets a UDP socket of its own.
+type RelayServer struct {
+	// Allow lists the destinations clients may send to. Loopback, link-local,
+	// private and unspecified addresses are only allowed by a prefix within
+	// their range, never by a wider one such as 0.0.0.0/0.
+	Allow []netip.Prefix
+	// Target is the only destination clients may send to when it is valid,
+	// whatever its address when Allow is empty. Clients may send nowhere
+	// without Allow or Target.
+	Target netip.AddrPort
+	// MaxHTTPSessions is the number of HTTP clients served at once, more get
+	// 503 Service Unavailable. DefaultMaxHTTPSessions when zero.
+	MaxHTTPSessions int
+
+	httpMu       sync.Mutex
+	httpSessions map[string]*httpRelaySession
+	// httpDeleted are the sessions ended by their client and when, so the
+	// requests still on their way do not create them again
+	httpDeleted map[string]time.Time
+}
+
+func (s *RelayServer) allowed(addr netip.AddrPort) bool {
+	if s.Target.IsValid() {
+		if addr != s.Target {
+			return false
+		}
+		if len(s.Allow) == 0 {
+			return true
+		}
+	}
+	dst := addr.Addr().Unmap()
+	scope := addrScope(dst)
+	for _, prefix := range s.Allow {
+		if !prefix.Contains(dst) {
+			continue
+		}
+		if scope == "" || addrScope(prefix.Masked().Addr()) == scope && addrScope(lastAddr(prefix)) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// addrScope names the range of addr the relay keeps its clients away from
+// unless it is listed, empty for a public address
+func addrScope(addr netip.Addr) string {
+	addr = addr.Unmap()
+	switch {
+	case addr.IsUnspecified():
+		return "unspecified"
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast():
+		return "link-local"
+	case addr.IsPrivate():
+		return "private"
+	case !addr.IsGlobalUnicast():
+		return "non-unicast"
+	}
+	return ""
+}
+
+// lastAddr returns the last address of prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().As16()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		bytes[i/8] |= 1 << (7 - i%8)
+	}
+	last := netip.AddrFrom16(bytes)
+	if prefix.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
+
+// Serve accepts the TCP or TLS streams of listener until ctx is done
+func (s *RelayServer) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	for {
+		stream, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeStream(stream); err != nil {
+				log.Printf("relay client %s: %v", stream.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// WebSocketHandler returns a handler serving relay clients over WebSocket
+func (s *RelayServer) WebSocketHandler() http.Handler {
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		if err := s.ServeStream(ws); err != nil {
+			log.Printf("relay client %s: %v", ws.Request().RemoteAddr, err)
+		}
+	}}
+}
+
+// ServeStream relays the datagrams of one client until its stream ends
+func (s *RelayServer) ServeStream(stream net.Conn) error {
+	defer stream.Close()
+
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+
+	// replies go back as frames, silence for relayIdleTimeout ends the client
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, 0xffff)
+		for {
+			_ = udp.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+			n, from, err := udp.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+			if err := writeRelayFrame(stream, from, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 0xffff+2)
+	for {
+		addr, payload, err := readRelayFrame(stream, buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.allowed(addr) {
+			continue
+		}
+		_, _ = udp.WriteToUDPAddrPort(payload, addr)
+	}
+}
@@ -0,0 +1,337 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+)
+
+// selfSignedCert returns a certificate for 127.0.0.1
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// trackingListener remembers the streams it accepted so a test can drop them
+type trackingListener struct {
+	net.Listener
+	mu      sync.Mutex
+	streams []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	stream, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.streams = append(l.streams, stream)
+		l.mu.Unlock()
+	}
+	return stream, err
+}
+
+func (l *trackingListener) dropStreams() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, stream := range l.streams {
+		_ = stream.Close()
+	}
+	l.streams = nil
+}
+
+// startRelay starts a relay server over transport and returns the URL of it
+// and the listener of its streams
+func startRelay(t *testing.T, ctx context.Context, transport string) (string, *trackingListener) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &trackingListener{Listener: inner}
+	server := &RelayServer{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+	switch transport {
+	case "tcp", "tls":
+		var serving net.Listener = listener
+		if transport == "tls" {
+			serving = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+		}
+		go func() { _ = server.Serve(ctx, serving) }()
+		return transport + "://" + listener.Addr().String(), listener
+	default:
+		handler := server.HTTPHandler()
+		if strings.HasPrefix(transport, "ws") {
+			handler = server.WebSocketHandler()
+		}
+		ts := httptest.NewUnstartedServer(handler)
+		ts.Listener.Close()
+		ts.Listener = listener
+		if transport == "wss" || transport == "https" {
+			ts.StartTLS()
+		} else {
+			ts.Start()
+		}
+		t.Cleanup(ts.Close)
+		if strings.HasPrefix(transport, "ws") {
+			return strings.Replace(ts.URL, "http", "ws", 1) + "/relay", listener
+		}
+		return ts.URL + "/relay", listener
+	}
+}
+
+func TestRelayBind(t *testing.T) {
+	for _, transport := range []string{"tcp", "tls", "ws", "wss", "http", "https"} {
+		transport := transport
+		t.Run(transport, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			relay, listener := startRelay(t, ctx, transport)
+			server, config := startTunnelServer(t, ctx, "10.0.0", nil)
+			conf, err := ParseConfigString(config+`
+[Upstream]
+Relay = `+relay+`
+Insecure = true
+`, "notset")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := StartChain(conf, false, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(client.Dev.Close)
+
+			echoTCP(t, ctx, client, server, netip.MustParseAddrPort("10.0.0.1:80"))
+
+			// the tunnel keeps working over new connections
+			listener.dropStreams()
+			echoTCP(t, ctx, client, server, netip.MustParseAddrPort("10.0.0.1:81"))
+		})
+	}
+}
+
+func TestRelayServerAllow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &RelayServer{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	go func() { _ = server.Serve(ctx, listener) }()
+
+	stream, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	addr := target.LocalAddr().(*net.UDPAddr).AddrPort()
+	if err := writeRelayFrame(stream, addr, []byte("denied")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = target.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := target.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Error("relay forwarded a datagram to a destination which is not allowed")
+	}
+}
+
+func TestParseUpstreamRelay(t *testing.T) {
+	upstream, err := ParseUpstream("wss://relay.example.com/wg?insecure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *upstream != (UpstreamConfig{Relay: "wss://relay.example.com/wg", Insecure: true}) {
+		t.Errorf("unexpected upstream %+v", upstream)
+	}
+	if _, err := ParseUpstream("udp://127.0.0.1:2408"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+	if _, err := ParseUpstream("socks5://127.0.0.1:1080"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelayServerTarget(t *testing.T) {
+	target := netip.MustParseAddrPort("127.0.0.1:2408")
+	server := &RelayServer{Target: target}
+	if !server.allowed(target) {
+		t.Error("target is not allowed")
+	}
+	if server.allowed(netip.MustParseAddrPort("127.0.0.1:2409")) {
+		t.Error("another port of the target is allowed")
+	}
+}
+
+func TestRelayServerAllowed(t *testing.T) {
+	open := &RelayServer{Allow: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}}
+	listed := &RelayServer{Allow: []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}}
+	for addr, allowed := range map[string][2]bool{
+		"162.159.192.1:2408":      {true, true},
+		"[2606:4700::1]:2408":     {true, false},
+		"127.0.0.1:2408":          {false, true},
+		"127.0.0.2:2408":          {false, false},
+		"10.1.2.3:2408":           {false, true},
+		"192.168.1.1:2408":        {false, false},
+		"169.254.169.254:80":      {false, false},
+		"0.0.0.0:2408":            {false, false},
+		"[::1]:2408":              {false, false},
+		"[fe80::1]:2408":          {false, false},
+		"[::ffff:127.0.0.1]:2408": {false, true},
+	} {
+		addrPort := netip.MustParseAddrPort(addr)
+		if open.allowed(addrPort) != allowed[0] || listed.allowed(addrPort) != allowed[1] {
+			t.Errorf("%s: allowed %v and %v when listed, expected %v", addr, open.allowed(addrPort), listed.allowed(addrPort), allowed)
+		}
+	}
+
+	// a relay without Allow or Target forwards nowhere
+	if (&RelayServer{}).allowed(netip.MustParseAddrPort("162.159.192.1:2408")) {
+		t.Error("relay without Allow or Target is open")
+	}
+}
+
+func TestHTTPRelaySessions(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	server := &RelayServer{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}}
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	bind, err := NewHTTPRelayBind(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+	if err := bind.Send([][]byte{[]byte("ping")}, &conn.StdNetEndpoint{AddrPort: addr}); err != nil {
+		t.Fatal(err)
+	}
+
+	packets, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+	if _, err := fns[0](packets, sizes, eps); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(packets[0][:sizes[0]]); got != "ping" || eps[0].(*conn.StdNetEndpoint).AddrPort != addr {
+		t.Errorf("got %q from %v", got, eps[0].DstToString())
+	}
+
+	// closing the bind ends its session on the relay
+	if err := bind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fns[0](packets, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close returned %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		server.httpMu.Lock()
+		sessions := len(server.httpSessions)
+		server.httpMu.Unlock()
+		if sessions == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("the session outlived the bind")
+}
+
+func TestHTTPRelayMaxSessions(t *testing.T) {
+	server := &RelayServer{Target: netip.MustParseAddrPort("127.0.0.1:2408"), MaxHTTPSessions: 2}
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	request := func(method, id string) int {
+		req, err := http.NewRequest(method, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(httpRelaySessionHeader, id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	ids := []string{strings.Repeat("01", 16), strings.Repeat("02", 16), strings.Repeat("03", 16)}
+	for _, id := range ids[:2] {
+		if status := request(http.MethodPost, id); status != http.StatusNoContent {
+			t.Fatalf("session %s answered %d", id, status)
+		}
+	}
+	if status := request(http.MethodPost, ids[2]); status != http.StatusServiceUnavailable {
+		t.Errorf("session beyond the limit answered %d", status)
+	}
+	// the open sessions are still served
+	if status := request(http.MethodPost, ids[0]); status != http.StatusNoContent {
+		t.Errorf("open session answered %d at the limit", status)
+	}
+
+	// and a session ended by its client makes room for another
+	if status := request(http.MethodDelete, ids[1]); status != http.StatusNoContent {
+		t.Fatalf("delete answered %d", status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for request(http.MethodPost, ids[2]) != http.StatusNoContent {
+		if time.Now().After(deadline) {
+			t.Fatal("no session once one was deleted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,236 @@
+package wiresocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// peerIPCRequest serializes the settings of a peer which differ from old, or
+// all of them when old is nil
+func peerIPCRequest(request *bytes.Buffer, peer, old *PeerConfig, endpoints map[string]string) {
+	request.WriteString(fmt.Sprintf("public_key=%s\n", peer.PublicKey))
+	if old != nil {
+		request.WriteString("update_only=true\n")
+	}
+
+	if old == nil || old.KeepAlive != peer.KeepAlive {
+		request.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", peer.KeepAlive))
+	}
+	if old == nil || old.PreSharedKey != peer.PreSharedKey {
+		request.WriteString(fmt.Sprintf("preshared_key=%s\n", peer.PreSharedKey))
+	}
+	if peer.Endpoint != nil && (old == nil || old.Endpoint == nil || *old.Endpoint != *peer.Endpoint) {
+		request.WriteString(fmt.Sprintf("endpoint=%s\n", deviceEndpoint(peer, endpoints)))
+	}
+
+	if old != nil && reflect.DeepEqual(old.AllowedIPs, peer.AllowedIPs) {
+		return
+	}
+	if old != nil {
+		request.WriteString("replace_allowed_ips=true\n")
+	}
+	if len(peer.AllowedIPs) > 0 {
+		for _, ip := range peer.AllowedIPs {
+			request.WriteString(fmt.Sprintf("allowed_ip=%s\n", ip.String()))
+		}
+	} else {
+		request.WriteString("allowed_ip=0.0.0.0/0\nallowed_ip=::0/0\n")
+	}
+}
+
+// diffIPCRequest serializes the changes needed to turn a device configured
+// with old into one configured with conf. Changes which cannot be applied to
+// a running device are returned as warnings. Peer endpoints are sent as
+// resolved in endpoints.
+func diffIPCRequest(old, conf *DeviceConfig, endpoints map[string]string) (string, []string) {
+	var request bytes.Buffer
+	var warnings []string
+
+	if old.SecretKey != conf.SecretKey {
+		request.WriteString(fmt.Sprintf("private_key=%s\n", conf.SecretKey))
+	}
+	if conf.ListenPort != nil && (old.ListenPort == nil || *old.ListenPort != *conf.ListenPort) {
+		request.WriteString(fmt.Sprintf("listen_port=%d\n", *conf.ListenPort))
+	}
+
+	oldPeers := make(map[string]*PeerConfig, len(old.Peers))
+	for i := range old.Peers {
+		oldPeers[old.Peers[i].PublicKey] = &old.Peers[i]
+	}
+
+	for i := range conf.Peers {
+		peer := &conf.Peers[i]
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		delete(oldPeers, peer.PublicKey)
+		if ok && reflect.DeepEqual(oldPeer, peer) {
+			continue
+		}
+		peerIPCRequest(&request, peer, oldPeer, endpoints)
+	}
+
+	for _, peer := range old.Peers {
+		if _, ok := oldPeers[peer.PublicKey]; ok {
+			request.WriteString(fmt.Sprintf("public_key=%s\nremove=true\n", peer.PublicKey))
+		}
+	}
+
+	if !reflect.DeepEqual(old.Endpoint, conf.Endpoint) {
+		warnings = append(warnings, "Address changed, restart to apply it")
+	}
+	if old.MTU != conf.MTU {
+		warnings = append(warnings, "MTU changed, restart to apply it")
+	}
+	if old.TCP != conf.TCP {
+		warnings = append(warnings, "TCP settings changed, restart to apply them")
+	}
+
+	return request.String(), warnings
+}
+
+// Reload applies conf to the running tunnel. Only the settings which differ
+// from the running configuration are sent to the device, so peers whose
+// settings did not change keep their sessions and proxied connections.
+func (vt *VirtualTun) Reload(conf *DeviceConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	vt.reloadMutex.Lock()
+	defer vt.reloadMutex.Unlock()
+
+	// only resolve the endpoints that changed, the others keep their address.
+	// The lookups run without confMutex so the proxies and the resolver are
+	// not held up by them.
+	vt.confMutex.Lock()
+	oldEndpoints := make(map[string]string, len(vt.conf.Peers))
+	for _, peer := range vt.conf.Peers {
+		if peer.Endpoint != nil {
+			oldEndpoints[peer.PublicKey] = *peer.Endpoint
+		}
+	}
+	vt.confMutex.Unlock()
+
+	resolved := make(map[string]string, len(conf.Peers))
+	for _, peer := range conf.Peers {
+		if peer.Endpoint == nil || oldEndpoints[peer.PublicKey] == *peer.Endpoint {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(vt.Ctx, resolveTimeout)
+		endpoint, err := conf.Resolver.resolveEndpoint(ctx, *peer.Endpoint, "")
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unable to resolve %s: %w", *peer.Endpoint, err)
+		}
+		resolved[peer.PublicKey] = endpoint
+	}
+
+	vt.confMutex.Lock()
+	defer vt.confMutex.Unlock()
+
+	endpoints := make(map[string]string, len(conf.Peers))
+	for _, peer := range conf.Peers {
+		if peer.Endpoint == nil {
+			continue
+		}
+		if endpoint, ok := resolved[peer.PublicKey]; ok {
+			endpoints[peer.PublicKey] = endpoint
+		} else if endpoint, ok := vt.endpoints[peer.PublicKey]; ok {
+			// the resolver may have moved it during the lookups
+			endpoints[peer.PublicKey] = endpoint
+		}
+	}
+
+	request, warnings := diffIPCRequest(vt.conf, conf, endpoints)
+	for _, warning := range warnings {
+		log.Println(warning)
+	}
+
+	if request != "" {
+		if err := vt.Dev.IpcSet(request); err != nil {
+			return err
+		}
+	}
+
+	if !reflect.DeepEqual(vt.conf.DNS, conf.DNS) {
+		vt.Tnet.SetDNSServers(conf.DNS)
+		vt.SystemDNS = len(conf.DNS) == 0
+	}
+
+	// keep what the device is actually running with
+	if len(warnings) > 0 {
+		applied := *conf
+		applied.Endpoint = vt.conf.Endpoint
+		applied.MTU = vt.conf.MTU
+		applied.TCP = vt.conf.TCP
+		conf = &applied
+	}
+	vt.conf = conf
+	vt.endpoints = endpoints
+	return nil
+}
+
+// ReloadFile parses the config file at path and applies it to the running tunnel
+func (vt *VirtualTun) ReloadFile(path, endpoint string) error {
+	conf, err := ParseConfig(path, endpoint)
+	if err != nil {
+		return err
+	}
+	return vt.Reload(conf.Device)
+}
+
+func fileDigest(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// WatchConfig reloads the config file at path whenever its content changes
+// or a value is sent on trigger, until ctx is done. A relative path is
+// relative to the working directory WatchConfig is called in.
+func (vt *VirtualTun) WatchConfig(ctx context.Context, path, endpoint string, interval time.Duration, trigger <-chan struct{}) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		log.Printf("unable to watch %s: %v", path, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-ticker.C:
+			current, err := fileDigest(path)
+			if err != nil || current == digest {
+				continue
+			}
+		}
+
+		current, err := fileDigest(path)
+		if err != nil {
+			log.Printf("unable to reload %s: %v", path, err)
+			continue
+		}
+		digest = current
+
+		if err := vt.ReloadFile(path, endpoint); err != nil {
+			log.Printf("unable to reload %s:\n%v", path, err)
+			continue
+		}
+		log.Printf("reloaded %s", path)
+	}
+}
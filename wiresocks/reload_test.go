@@ -0,0 +1,92 @@
+package wiresocks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffIPCRequest(t *testing.T) {
+	old, err := ParseConfigString(testConfig, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := strings.Replace(testConfig, "Endpoint = 127.0.0.1:51820", "Endpoint = 127.0.0.2:51820", 1)
+	config = strings.Replace(config, "AllowedIPs = 10.0.0.3/32", "AllowedIPs = 10.0.0.4/32", 1)
+	config = strings.Replace(config, "MTU = 1280", "MTU = 1400", 1)
+	conf, err := ParseConfigString(config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, warnings := diffIPCRequest(old.Device, old.Device, nil)
+	if request != "" || len(warnings) != 0 {
+		t.Errorf("unexpected diff of identical configs: %q %v", request, warnings)
+	}
+
+	request, warnings = diffIPCRequest(old.Device, conf.Device, nil)
+	expected := "public_key=" + conf.Device.Peers[0].PublicKey + "\nupdate_only=true\nendpoint=127.0.0.2:51820\n" +
+		"public_key=" + conf.Device.Peers[1].PublicKey + "\nupdate_only=true\nreplace_allowed_ips=true\nallowed_ip=10.0.0.4/32\n"
+	if request != expected {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", request, expected)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected a warning about the MTU, got %v", warnings)
+	}
+
+	conf.Device.Peers = conf.Device.Peers[:1]
+	request, _ = diffIPCRequest(old.Device, conf.Device, nil)
+	if !strings.HasSuffix(request, "public_key="+old.Device.Peers[1].PublicKey+"\nremove=true\n") {
+		t.Errorf("expected removal of the second peer:\n%s", request)
+	}
+}
+
+func TestWatchConfigRelative(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, config := startTunnelServer(t, ctx, "10.0.0", nil)
+	client := startTunnel(t, ctx, config, nil)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.conf")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	// the watcher has taken the path once it accepts a trigger
+	trigger := make(chan struct{})
+	go client.WatchConfig(ctx, "client.conf", "notset", time.Hour, trigger)
+	trigger <- struct{}{}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(config+"PersistentKeepalive = 7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	trigger <- struct{}{}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		ipc, err := client.Dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(ipc, "persistent_keepalive_interval=7\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("config not reloaded after the working directory changed")
+		}
+	}
+}
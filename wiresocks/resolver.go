@@ -0,0 +1,447 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/device"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	warpEndpointHost = "engage.cloudflareclient.com"
+	resolveTimeout   = 10 * time.Second
+)
+
+// ResolverOptions controls how hostname endpoints are resolved and how often
+// they are resolved again while the tunnel is running
+type ResolverOptions struct {
+	// Interval between periodic re-resolutions, zero disables them
+	Interval time.Duration
+	// FailureThreshold is the number of consecutive failed handshakes after
+	// which the endpoint is resolved again, zero disables it
+	FailureThreshold int
+	// Prefer is "ipv4" or "ipv6" to pick addresses of that family first
+	Prefer string
+	// DoH is the URL of a DNS-over-HTTPS resolver used instead of the host DNS
+	DoH string
+}
+
+// DefaultResolverOptions are used when a config has no [Resolver] section
+var DefaultResolverOptions = ResolverOptions{
+	Interval:         5 * time.Minute,
+	FailureThreshold: 3,
+}
+
+// lookupHost resolves host to its addresses, ordered by the preferred family
+func (opts *ResolverOptions) lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	var addrs []netip.Addr
+	var err error
+	if opts.DoH != "" {
+		addrs, err = lookupDoH(ctx, opts.DoH, host)
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	// the system resolver returns IPv4 addresses mapped to IPv6, which the
+	// bind would send from its IPv6 socket
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	if opts.Prefer == "" {
+		return addrs, nil
+	}
+
+	var preferred, others []netip.Addr
+	for _, addr := range addrs {
+		if (opts.Prefer == "ipv6") == addr.Is6() {
+			preferred = append(preferred, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	return append(preferred, others...), nil
+}
+
+// resolveEndpoint resolves a host:port endpoint to ip:port. An address other
+// than avoid is picked when there is a choice.
+func (opts *ResolverOptions) resolveEndpoint(ctx context.Context, endpoint, avoid string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(host, warpEndpointHost) {
+		// the warp endpoint is picked at random from the known ranges
+		return ResolveIPPAndPort(strings.ToLower(endpoint))
+	}
+
+	addrs, err := opts.lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if resolved := net.JoinHostPort(addr.String(), port); resolved != avoid {
+			return resolved, nil
+		}
+	}
+	return net.JoinHostPort(addrs[0].String(), port), nil
+}
+
+// lookupDoH resolves the A and AAAA records of host with an RFC 8484 resolver
+func lookupDoH(ctx context.Context, server, host string) ([]netip.Addr, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		query, err := (&dnsmessage.Message{
+			Header: dnsmessage.Header{RecursionDesired: true},
+			Questions: []dnsmessage.Question{{
+				Name:  name,
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			}},
+		}).Pack()
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			server+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/dns-message")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("DoH resolver returned %s", resp.Status)
+			continue
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(body); err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range msg.Answers {
+			switch r := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(r.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+			}
+		}
+	}
+
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return addrs, nil
+}
+
+// peerStat is the state of a peer as reported by the device
+type peerStat struct {
+	endpoint      string
+	lastHandshake time.Time
+	txBytes       uint64
+	rxBytes       uint64
+}
+
+// peerStats returns the state of every peer of dev keyed by hex public key
+func peerStats(dev *device.Device) (map[string]*peerStat, error) {
+	ipc, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*peerStat)
+	var current *peerStat
+	var secs int64
+	scanner := bufio.NewScanner(strings.NewReader(ipc))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			current = &peerStat{}
+			stats[value] = current
+		case "endpoint":
+			if current != nil {
+				current.endpoint = value
+			}
+		case "last_handshake_time_sec":
+			secs, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsecs, _ := strconv.ParseInt(value, 10, 64)
+			if current != nil && (secs != 0 || nsecs != 0) {
+				current.lastHandshake = time.Unix(secs, nsecs)
+			}
+		case "tx_bytes":
+			if current != nil {
+				current.txBytes, _ = strconv.ParseUint(value, 10, 64)
+			}
+		case "rx_bytes":
+			if current != nil {
+				current.rxBytes, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// resolvePeerEndpoints resolves the endpoint of every peer of conf, keyed by
+// hex public key
+func resolvePeerEndpoints(ctx context.Context, conf *DeviceConfig) (map[string]string, error) {
+	endpoints := make(map[string]string)
+	for _, peer := range conf.Peers {
+		if peer.Endpoint == nil {
+			continue
+		}
+		resolved, err := conf.Resolver.resolveEndpoint(ctx, *peer.Endpoint, "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve %s: %w", *peer.Endpoint, err)
+		}
+		endpoints[peer.PublicKey] = resolved
+	}
+	return endpoints, nil
+}
+
+// deviceEndpoint returns the address the device should use to reach peer
+func deviceEndpoint(peer *PeerConfig, endpoints map[string]string) string {
+	if resolved, ok := endpoints[peer.PublicKey]; ok {
+		return resolved
+	}
+	return *peer.Endpoint
+}
+
+// isHostnameEndpoint reports whether endpoint names a host instead of an address
+func isHostnameEndpoint(endpoint string) bool {
+	_, err := netip.ParseAddrPort(endpoint)
+	return err != nil
+}
+
+// endpointWatch is what watchEndpoints remembers between its checks
+type endpointWatch struct {
+	started     time.Time
+	lastResolve time.Time
+	lastTx      map[string]uint64
+	// movedAt is when the endpoint of a peer last changed, handshakes with
+	// the new address are only expected from then on
+	movedAt map[string]time.Time
+}
+
+// endpointCheck is a hostname endpoint to resolve again
+type endpointCheck struct {
+	publicKey string
+	endpoint  string
+	current   string
+	failing   bool
+}
+
+// watchEndpoints resolves the hostname endpoints of the tunnel again every
+// Resolver.Interval, and as soon as a peer fails Resolver.FailureThreshold
+// handshakes in a row, pushing the new addresses to the device
+func (vt *VirtualTun) watchEndpoints() {
+	ticker := time.NewTicker(device.RekeyTimeout)
+	defer ticker.Stop()
+
+	now := time.Now()
+	w := &endpointWatch{
+		started:     now,
+		lastResolve: now,
+		lastTx:      make(map[string]uint64),
+		movedAt:     make(map[string]time.Time),
+	}
+	for {
+		select {
+		case <-vt.Ctx.Done():
+			return
+		case <-vt.Dev.Wait():
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := peerStats(vt.Dev)
+		if err != nil {
+			continue
+		}
+		vt.checkEndpoints(w, stats, time.Now())
+	}
+}
+
+// checkEndpoints resolves the endpoints due at now given the stats of the
+// device. The lookups run without confMutex, which reloads and the monitor
+// would otherwise wait on for as long as the resolver takes.
+func (vt *VirtualTun) checkEndpoints(w *endpointWatch, stats map[string]*peerStat, now time.Time) {
+	vt.confMutex.Lock()
+	opts := vt.conf.Resolver
+	periodic := opts.Interval > 0 && now.Sub(w.lastResolve) >= opts.Interval
+	if periodic {
+		w.lastResolve = now
+	}
+
+	var checks []endpointCheck
+	for _, peer := range vt.conf.Peers {
+		stat, ok := stats[peer.PublicKey]
+		if !ok || peer.Endpoint == nil || !isHostnameEndpoint(*peer.Endpoint) {
+			continue
+		}
+
+		// while handshakes fail the device keeps sending initiations every
+		// RekeyTimeout, so tx grows while the last handshake gets older
+		failing := false
+		if opts.FailureThreshold > 0 && stat.txBytes > w.lastTx[peer.PublicKey] {
+			expected := stat.lastHandshake.Add(device.RekeyAfterTime)
+			if expected.Before(w.started) {
+				expected = w.started
+			}
+			if moved, ok := w.movedAt[peer.PublicKey]; ok && moved.After(expected) {
+				expected = moved
+			}
+			failing = now.Sub(expected) > time.Duration(opts.FailureThreshold)*device.RekeyTimeout
+		}
+		w.lastTx[peer.PublicKey] = stat.txBytes
+
+		if failing || (periodic && !strings.EqualFold(hostOf(*peer.Endpoint), warpEndpointHost)) {
+			checks = append(checks, endpointCheck{
+				publicKey: peer.PublicKey,
+				endpoint:  *peer.Endpoint,
+				current:   vt.endpoints[peer.PublicKey],
+				failing:   failing,
+			})
+		}
+	}
+	vt.confMutex.Unlock()
+
+	for _, check := range checks {
+		var resolved string
+		var err error
+		if check.failing {
+			resolved, err = vt.resolveWithTimeout(&opts, check.endpoint, check.current)
+		} else {
+			// only move when the current address is gone from the records
+			var addrs []string
+			addrs, err = vt.lookupEndpoint(&opts, check.endpoint)
+			if err == nil && len(addrs) > 0 && !contains(addrs, check.current) {
+				resolved = addrs[0]
+			}
+		}
+		if err != nil {
+			log.Printf("unable to resolve %s: %v", check.endpoint, err)
+			continue
+		}
+		if resolved == "" || resolved == check.current {
+			continue
+		}
+		vt.moveResolvedEndpoint(w, check, resolved, now)
+	}
+}
+
+// moveResolvedEndpoint points the peer of check to resolved, unless a reload
+// or the monitor changed its endpoint during the lookup
+func (vt *VirtualTun) moveResolvedEndpoint(w *endpointWatch, check endpointCheck, resolved string, now time.Time) {
+	vt.confMutex.Lock()
+	defer vt.confMutex.Unlock()
+
+	if vt.endpoints[check.publicKey] != check.current {
+		return
+	}
+	found := false
+	for _, peer := range vt.conf.Peers {
+		if peer.PublicKey == check.publicKey && peer.Endpoint != nil && *peer.Endpoint == check.endpoint {
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	err := vt.Dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", check.publicKey, resolved))
+	if err != nil {
+		log.Printf("unable to update endpoint %s: %v", check.endpoint, err)
+		return
+	}
+	vt.endpoints[check.publicKey] = resolved
+	w.movedAt[check.publicKey] = now
+	log.Printf("endpoint %s moved from %s to %s", check.endpoint, check.current, resolved)
+}
+
+func (vt *VirtualTun) resolveWithTimeout(opts *ResolverOptions, endpoint, avoid string) (string, error) {
+	ctx, cancel := context.WithTimeout(vt.Ctx, resolveTimeout)
+	defer cancel()
+	return opts.resolveEndpoint(ctx, endpoint, avoid)
+}
+
+// lookupEndpoint returns every ip:port endpoint resolves to
+func (vt *VirtualTun) lookupEndpoint(opts *ResolverOptions, endpoint string) ([]string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(vt.Ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := opts.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = net.JoinHostPort(addr.String(), port)
+	}
+	return endpoints, nil
+}
+
+func hostOf(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return host
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/device"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohServer answers the DNS-over-HTTPS queries for wg.test with its records,
+// holding them while block is set
+type dohServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	records []netip.Addr
+	block   chan struct{}
+	queried chan struct{}
+}
+
+func startDoHServer(t *testing.T, records ...string) *dohServer {
+	s := &dohServer{queried: make(chan struct{}, 16)}
+	s.setRecords(records...)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *dohServer) setRecords(records ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = nil
+	for _, record := range records {
+		s.records = append(s.records, netip.MustParseAddr(record))
+	}
+}
+
+func (s *dohServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.queried <- struct{}{}
+	s.mu.Lock()
+	block, records := s.block, s.records
+	s.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	var query dnsmessage.Message
+	if err == nil {
+		err = query.Unpack(data)
+	}
+	if err != nil || len(query.Questions) != 1 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	question := query.Questions[0]
+	reply := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true},
+		Questions: query.Questions,
+	}
+	for _, addr := range records {
+		if question.Name.String() != "wg.test." {
+			break
+		}
+		header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case question.Type == dnsmessage.TypeA && addr.Is4():
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(packed)
+}
+
+func TestLookupDoH(t *testing.T) {
+	server := startDoHServer(t, "192.0.2.1", "2001:db8::1")
+	addrs, err := lookupDoH(context.Background(), server.URL, "wg.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(addrs) != "[192.0.2.1 2001:db8::1]" {
+		t.Errorf("resolved %v", addrs)
+	}
+
+	opts := ResolverOptions{DoH: server.URL, Prefer: "ipv6"}
+	if endpoint, err := opts.resolveEndpoint(context.Background(), "wg.test:2408", ""); err != nil || endpoint != "[2001:db8::1]:2408" {
+		t.Errorf("resolved %s, %v preferring ipv6", endpoint, err)
+	}
+
+	if addrs, err := lookupDoH(context.Background(), server.URL+"/missing?", "wg.test"); err == nil {
+		t.Errorf("resolved %v through a failing resolver", addrs)
+	}
+}
+
+func TestResolveEndpointSystem(t *testing.T) {
+	// IPv4 answers of the system resolver are not left mapped to IPv6
+	var opts ResolverOptions
+	endpoint, err := opts.resolveEndpoint(context.Background(), "localhost:51820", "[::1]:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != "127.0.0.1:51820" {
+		t.Errorf("resolved localhost to %s", endpoint)
+	}
+}
+
+// resolvingTunnel starts a tunnel whose peer endpoint wg.test:51820 resolves
+// through server, currently to 192.0.2.1
+func resolvingTunnel(t *testing.T, ctx context.Context, server *dohServer) (*VirtualTun, string) {
+	_, config := startTunnelServer(t, ctx, "10.0.0", nil)
+	vt := startTunnel(t, ctx, config, nil)
+
+	vt.confMutex.Lock()
+	defer vt.confMutex.Unlock()
+	vt.conf.Resolver = ResolverOptions{Interval: time.Hour, FailureThreshold: 3, DoH: server.URL}
+	peer := &vt.conf.Peers[0]
+	endpoint := "wg.test:51820"
+	peer.Endpoint = &endpoint
+	vt.endpoints[peer.PublicKey] = "192.0.2.1:51820"
+	return vt, peer.PublicKey
+}
+
+func deviceEndpointOf(t *testing.T, vt *VirtualTun, publicKey string) string {
+	stats, err := peerStats(vt.Dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats[publicKey].endpoint
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := startDoHServer(t, "192.0.2.1")
+	vt, publicKey := resolvingTunnel(t, ctx, server)
+
+	now := time.Now()
+	w := &endpointWatch{
+		started:     now.Add(-time.Minute),
+		lastResolve: now.Add(-time.Minute),
+		lastTx:      map[string]uint64{publicKey: 100},
+		movedAt:     make(map[string]time.Time),
+	}
+	healthy := map[string]*peerStat{publicKey: {lastHandshake: now, txBytes: 100}}
+
+	// nothing is resolved before the interval
+	vt.checkEndpoints(w, healthy, now)
+	select {
+	case <-server.queried:
+		t.Fatal("resolved before the interval")
+	default:
+	}
+
+	// the periodic lookup keeps an address still in the records
+	server.setRecords("192.0.2.2", "192.0.2.1")
+	now = now.Add(time.Hour)
+	vt.checkEndpoints(w, healthy, now)
+	if endpoint := vt.endpoints[publicKey]; endpoint != "192.0.2.1:51820" {
+		t.Errorf("moved to %s while the address was still in the records", endpoint)
+	}
+
+	// and moves away from one which is gone
+	server.setRecords("192.0.2.2")
+	now = now.Add(time.Hour)
+	vt.checkEndpoints(w, healthy, now)
+	if endpoint := deviceEndpointOf(t, vt, publicKey); endpoint != "192.0.2.2:51820" || vt.endpoints[publicKey] != endpoint {
+		t.Errorf("periodic lookup moved the device to %s", endpoint)
+	}
+
+	// handshakes failing past the threshold move to another address at once
+	server.setRecords("192.0.2.2", "192.0.2.3")
+	now = now.Add(4 * device.RekeyTimeout)
+	failing := map[string]*peerStat{publicKey: {lastHandshake: now.Add(-2 * device.RekeyAfterTime), txBytes: 200}}
+	vt.checkEndpoints(w, failing, now)
+	if endpoint := deviceEndpointOf(t, vt, publicKey); endpoint != "192.0.2.3:51820" {
+		t.Errorf("failing handshakes moved the device to %s", endpoint)
+	}
+}
+
+func TestCheckEndpointsUnlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := startDoHServer(t, "192.0.2.2")
+	vt, publicKey := resolvingTunnel(t, ctx, server)
+
+	block := make(chan struct{})
+	server.mu.Lock()
+	server.block = block
+	server.mu.Unlock()
+	defer close(block)
+
+	now := time.Now()
+	w := &endpointWatch{
+		started:     now.Add(-2 * time.Hour),
+		lastResolve: now.Add(-2 * time.Hour),
+		lastTx:      map[string]uint64{publicKey: 100},
+		movedAt:     make(map[string]time.Time),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vt.checkEndpoints(w, map[string]*peerStat{publicKey: {lastHandshake: now, txBytes: 100}}, now)
+	}()
+
+	// the config stays available while the resolver hangs
+	<-server.queried
+	locked := make(chan struct{})
+	go func() {
+		vt.confMutex.Lock()
+		vt.confMutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("confMutex held during the lookup")
+	}
+
+	// a reload during the lookup wins over its result
+	vt.confMutex.Lock()
+	vt.endpoints[publicKey] = "192.0.2.9:51820"
+	vt.confMutex.Unlock()
+	server.mu.Lock()
+	server.block = nil
+	server.mu.Unlock()
+	block <- struct{}{}
+	<-done
+	if endpoint := vt.endpoints[publicKey]; endpoint != "192.0.2.9:51820" {
+		t.Errorf("lookup overwrote the endpoint set during it with %s", endpoint)
+	}
+	if strings.Contains(deviceEndpointOf(t, vt, publicKey), "192.0.2.2") {
+		t.Error("lookup moved the device after the endpoint changed")
+	}
+}
+
+func TestReloadUnlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := startDoHServer(t, "192.0.2.2")
+	vt, publicKey := resolvingTunnel(t, ctx, server)
+
+	block := make(chan struct{})
+	server.mu.Lock()
+	server.block = block
+	server.mu.Unlock()
+
+	vt.confMutex.Lock()
+	conf := *vt.conf
+	conf.Peers = append([]PeerConfig(nil), vt.conf.Peers...)
+	vt.confMutex.Unlock()
+	endpoint := "wg.test:51821"
+	conf.Peers[0].Endpoint = &endpoint
+
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- vt.Reload(&conf) }()
+
+	// the config stays available while the endpoint is looked up
+	<-server.queried
+	locked := make(chan struct{})
+	go func() {
+		vt.confMutex.Lock()
+		vt.confMutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("confMutex held during the lookup")
+	}
+
+	close(block)
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := deviceEndpointOf(t, vt, publicKey); endpoint != "192.0.2.2:51821" {
+		t.Errorf("reload moved the device to %s", endpoint)
+	}
+}
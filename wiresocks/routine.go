@@ -0,0 +1,223 @@
+package wiresocks
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/http"
+	"github.com/bepass-org/proxy/pkg/socks5"
+)
+
+// RoutineSpawner spawns a routine (e.g. a port forward) on top of a VirtualTun
+type RoutineSpawner interface {
+	SpawnRoutine(vt *VirtualTun)
+}
+
+// Socks5Config serves a socks5 proxy on BindAddress, optionally protected by
+// a username and password
+type Socks5Config struct {
+	BindAddress string
+	Username    string
+	Password    string
+}
+
+// HTTPConfig serves an http proxy on BindAddress, optionally protected by
+// basic authentication
+type HTTPConfig struct {
+	BindAddress string
+	Username    string
+	Password    string
+}
+
+// TCPClientTunnelConfig listens on a local TCP address and forwards every
+// accepted connection to Target through the tunnel
+type TCPClientTunnelConfig struct {
+	BindAddress *net.TCPAddr
+	Target      string
+}
+
+// TCPServerTunnelConfig listens on ListenPort of the tunnel address and
+// forwards every accepted connection to Target on the host network
+type TCPServerTunnelConfig struct {
+	ListenPort int
+	Target     string
+}
+
+// UDPProxyTunnelConfig listens on a local UDP address and forwards the
+// datagrams of every client to Target through the tunnel
+type UDPProxyTunnelConfig struct {
+	BindAddress       *net.UDPAddr
+	Target            string
+	InactivityTimeout int
+}
+
+// SpawnRoutine spawns a socks5 server
+func (conf *Socks5Config) SpawnRoutine(vt *VirtualTun) {
+	server := socks5.NewServer(
+		socks5.WithLogger(vt.Logger),
+		socks5.WithContext(vt.Ctx),
+		socks5.WithConnectHandle(vt.generalHandler),
+		socks5.WithAssociateHandle(vt.generalHandler),
+	)
+	serveProxy(vt, "Socks5", conf.BindAddress, func(conn net.Conn) error {
+		if conf.Username != "" || conf.Password != "" {
+			var err error
+			conn, err = socks5Authenticate(conn, conf.Username, conf.Password)
+			if err != nil {
+				return err
+			}
+		}
+		return server.ServeConn(conn)
+	})
+}
+
+// SpawnRoutine spawns an http proxy server
+func (conf *HTTPConfig) SpawnRoutine(vt *VirtualTun) {
+	server := http.NewServer(
+		http.WithLogger(vt.Logger),
+		http.WithContext(vt.Ctx),
+		http.WithConnectHandle(vt.generalHandler),
+	)
+	serveProxy(vt, "http", conf.BindAddress, func(conn net.Conn) error {
+		if conf.Username != "" || conf.Password != "" {
+			var err error
+			conn, err = httpAuthenticate(conn, conf.Username, conf.Password)
+			if err != nil {
+				return err
+			}
+		}
+		return server.ServeConn(conn)
+	})
+}
+
+// serveProxy accepts connections on bindAddress and hands them to serve
+func serveProxy(vt *VirtualTun, name, bindAddress string, serve func(conn net.Conn) error) {
+	listener, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		log.Printf("%s %s: %v", name, bindAddress, err)
+		return
+	}
+	go closeOnDone(vt, listener)
+
+	log.Printf("%s proxy serving on %s", name, bindAddress)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if vt.Ctx.Err() == nil {
+				log.Printf("%s %s: %v", name, bindAddress, err)
+			}
+			return
+		}
+		go func() {
+			if err := serve(conn); err != nil {
+				vt.Logger.Debug(name, conn.RemoteAddr(), err)
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// SpawnRoutine spawns a local TCP server which forwards connections to Target
+func (conf *TCPClientTunnelConfig) SpawnRoutine(vt *VirtualTun) {
+	listener, err := net.ListenTCP("tcp", conf.BindAddress)
+	if err != nil {
+		log.Printf("TCPClientTunnel %s: %v", conf.BindAddress, err)
+		return
+	}
+	go closeOnDone(vt, listener)
+
+	log.Printf("TCPClientTunnel forwarding %s to %s", conf.BindAddress, conf.Target)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if vt.Ctx.Err() == nil {
+				log.Printf("TCPClientTunnel %s: %v", conf.BindAddress, err)
+			}
+			return
+		}
+		go func() {
+			target, err := vt.Tnet.DialContext(vt.Ctx, "tcp", conf.Target)
+			if err != nil {
+				log.Printf("TCPClientTunnel unable to dial %s: %v", conf.Target, err)
+				_ = client.Close()
+				return
+			}
+			forwardConn(client, target)
+		}()
+	}
+}
+
+// SpawnRoutine spawns a TCP server on the tunnel which forwards connections
+// to Target on the host network
+func (conf *TCPServerTunnelConfig) SpawnRoutine(vt *VirtualTun) {
+	listener, err := vt.Tnet.ListenTCP(&net.TCPAddr{Port: conf.ListenPort})
+	if err != nil {
+		log.Printf("TCPServerTunnel :%d: %v", conf.ListenPort, err)
+		return
+	}
+	go closeOnDone(vt, listener)
+
+	log.Printf("TCPServerTunnel forwarding tunnel port %d to %s", conf.ListenPort, conf.Target)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if vt.Ctx.Err() == nil {
+				log.Printf("TCPServerTunnel :%d: %v", conf.ListenPort, err)
+			}
+			return
+		}
+		go func() {
+			var dialer net.Dialer
+			target, err := dialer.DialContext(vt.Ctx, "tcp", conf.Target)
+			if err != nil {
+				log.Printf("TCPServerTunnel unable to dial %s: %v", conf.Target, err)
+				_ = client.Close()
+				return
+			}
+			forwardConn(client, target)
+		}()
+	}
+}
+
+// SpawnRoutine spawns a local UDP server which forwards datagrams to Target.
+// Every client address gets its own connection through the tunnel, which is
+// dropped after InactivityTimeout seconds without traffic either way.
+func (conf *UDPProxyTunnelConfig) SpawnRoutine(vt *VirtualTun) {
+	timeout := time.Duration(conf.InactivityTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = udpSessionTimeout
+	}
+	forwarder, err := newVtunUDPForwarder(conf.BindAddress.String(), conf.Target, vt, 65535, timeout, vt.Ctx)
+	if err != nil {
+		log.Printf("UDPProxyTunnel %s: %v", conf.BindAddress, err)
+		return
+	}
+	log.Printf("UDPProxyTunnel forwarding %s to %s", forwarder.LocalAddr(), conf.Target)
+	forwarder.Wait()
+}
+
+// closeOnDone closes c once the tunnel context is done
+func closeOnDone(vt *VirtualTun, c io.Closer) {
+	<-vt.Ctx.Done()
+	_ = c.Close()
+}
+
+// forwardConn copies data between a and b in both directions until one
+// side is done, then closes both connections
+func forwardConn(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
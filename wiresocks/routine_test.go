@@ -0,0 +1,167 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address whose port was free a moment ago
+func freeAddr(t *testing.T, network string) string {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// echoThrough dials until the routine listens and checks that a message
+// comes back unchanged through it
+func echoThrough(t *testing.T, dial func() (net.Conn, error)) {
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if conn, err = dial(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("forwarded")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("forwarded"))
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "forwarded" {
+		t.Fatalf("read %q, %v through the forward", buf, err)
+	}
+}
+
+func TestTCPClientTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, server := startTunnelPair(t, ctx, "10.0.0", nil, nil)
+
+	listener, err := server.Tnet.ListenTCPAddrPort(netip.MustParseAddrPort("10.0.0.1:22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	bind, err := net.ResolveTCPAddr("tcp", freeAddr(t, "tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&TCPClientTunnelConfig{BindAddress: bind, Target: "10.0.0.1:22"}).SpawnRoutine(client)
+	echoThrough(t, func() (net.Conn, error) { return net.Dial("tcp", bind.String()) })
+}
+
+func TestTCPServerTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, server := startTunnelPair(t, ctx, "10.0.0", nil, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	go (&TCPServerTunnelConfig{ListenPort: 8080, Target: listener.Addr().String()}).SpawnRoutine(server)
+	echoThrough(t, func() (net.Conn, error) {
+		dialCtx, dialCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer dialCancel()
+		return client.Tnet.DialContextTCPAddrPort(dialCtx, netip.MustParseAddrPort("10.0.0.1:8080"))
+	})
+}
+
+func TestUDPProxyTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, server := startTunnelPair(t, ctx, "10.0.0", nil, nil)
+
+	target, err := server.Tnet.ListenUDPAddrPort(netip.MustParseAddrPort("10.0.0.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	bind, err := net.ResolveUDPAddr("udp", freeAddr(t, "udp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&UDPProxyTunnelConfig{BindAddress: bind, Target: "10.0.0.1:53", InactivityTimeout: 1}).SpawnRoutine(client)
+	conn, err := net.Dial("udp", bind.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the first datagrams may be lost while the routine starts and the
+	// handshake completes
+	buf := make([]byte, 1500)
+	var source net.Addr
+	for deadline := time.Now().Add(30 * time.Second); source == nil && time.Now().Before(deadline); {
+		_, _ = conn.Write([]byte("query"))
+		_ = target.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, source, _ = target.ReadFrom(buf)
+	}
+	if source == nil {
+		t.Fatal("no datagram went through the forward")
+	}
+
+	// those of a client which only sends for longer than the timeout keep
+	// coming from a single tunnel socket
+	for i := 0; i < 8; i++ {
+		time.Sleep(300 * time.Millisecond)
+		if _, err := conn.Write([]byte("query")); err != nil {
+			t.Fatal(err)
+		}
+		_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, addr, err := target.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != source.String() {
+			t.Fatalf("datagram came from %v after %v, the session was dropped", addr, source)
+		}
+	}
+
+	if _, err := target.WriteTo([]byte("answer"), source); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("read %q, %v, expected the answer", buf[:n], err)
+	}
+}
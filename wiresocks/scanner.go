@@ -2,22 +2,114 @@ package wiresocks
 
 import (
 	"context"
-	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/bepass-org/ipscanner"
-	"github.com/go-ini/ini"
+	"github.com/bepass-org/wireguard-go/device"
 	"log"
+	"math"
+	"math/rand"
 	"net"
-	"strings"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func canConnectIPv6(remoteAddr string) bool {
+// ScanOptions controls which endpoints are scanned and how they are measured
+type ScanOptions struct {
+	// hex encoded keys of the identity used for the handshakes, as in DeviceConfig
+	PrivateKey   string
+	PublicKey    string
+	PresharedKey string
+
+	CIDRs   []string
+	Ports   []int
+	UseIPv4 bool
+	UseIPv6 bool
+	// ProbeIPv6 keeps UseIPv6 only when IPv6 connectivity is found as the
+	// scan starts
+	ProbeIPv6 bool
+	// Junk sends the random packets the tunnel sends ahead of handshakes
+	// with every probe, which makes probes slower but closer to the tunnel
+	Junk bool
+
+	// PortsPerIP is the number of ports tried on every IP, zero tries them
+	// all. Ports which passed before on this network are tried first and
+	// ports which always failed are skipped.
+	PortsPerIP int
+	// Network names the network the scan runs from, the source address of
+	// outbound traffic when empty
+	Network string
+
+	// Candidates is the number of responsive IPs to measure
+	Candidates int
+	// Concurrency is the number of handshakes in flight at once
+	Concurrency int
+	// MaxRTT is the slowest handshake an endpoint may take to be kept
+	MaxRTT time.Duration
+	// Samples is the number of handshakes made with every endpoint
+	Samples int
+	// Timeout bounds the whole scan
+	Timeout time.Duration
+
+	// CacheFile keeps the results between runs, results younger than
+	// CacheTTL are used instead of scanning again
+	CacheFile string
+	CacheTTL  time.Duration
+}
+
+// ScanResult is the measurement of an endpoint
+type ScanResult struct {
+	Network    string    `json:"network"`
+	Endpoint   string    `json:"endpoint"`
+	RTT        float64   `json:"rtt_ms"` // median handshake time in milliseconds
+	Loss       float64   `json:"loss"`   // share of the samples without a handshake
+	Samples    int       `json:"samples"`
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+var warpPorts = []int{500, 854, 859, 864, 878, 880, 890, 891, 894, 903, 908, 928, 934, 939, 942,
+	943, 945, 946, 955, 968, 987, 988, 1002, 1010, 1014, 1018, 1070, 1074, 1180, 1387, 1701,
+	1843, 2371, 2408, 2506, 3138, 3476, 3581, 3854, 4177, 4198, 4233, 4500, 5279,
+	5956, 7103, 7152, 7156, 7281, 7559, 8319, 8742, 8854, 8886}
+
+// DefaultScanOptions returns the options for scanning the warp ranges
+func DefaultScanOptions() ScanOptions {
+	return ScanOptions{
+		CIDRs: []string{
+			"162.159.192.0/24",
+			"162.159.193.0/24",
+			"162.159.195.0/24",
+			"188.114.96.0/24",
+			"188.114.97.0/24",
+			"188.114.98.0/24",
+			"188.114.99.0/24",
+			"2606:4700:d0::/48",
+			"2606:4700:d1::/48",
+		},
+		Ports:       warpPorts,
+		PortsPerIP:  4,
+		UseIPv4:     true,
+		UseIPv6:     true,
+		ProbeIPv6:   true,
+		Candidates:  8,
+		Concurrency: 4,
+		MaxRTT:      500 * time.Millisecond,
+		Samples:     3,
+		Timeout:     2 * time.Minute,
+		CacheTTL:    6 * time.Hour,
+	}
+}
+
+func canConnectIPv6(ctx context.Context, remoteAddr string) bool {
 	dialer := net.Dialer{
 		Timeout: 5 * time.Second,
 	}
 
-	conn, err := dialer.Dial("tcp6", remoteAddr)
+	conn, err := dialer.DialContext(ctx, "tcp6", remoteAddr)
 	if err != nil {
 		return false
 	}
@@ -25,85 +117,475 @@ func canConnectIPv6(remoteAddr string) bool {
 	return true
 }
 
-func RunScan(ctx *context.Context) (result []string, err error) {
-	cfg, err := ini.Load("./primary/wgcf-profile.ini")
+// NetworkID identifies the network we are on by the source address used to
+// reach the warp ranges, as port blocking differs from network to network
+func NetworkID() string {
+	conn, err := net.Dial("udp", "162.159.192.1:2408")
 	if err != nil {
-		log.Printf("Failed to read file: %v", err)
-		return nil, fmt.Errorf("failed to read file: %v", err)
+		return "unknown"
 	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
 
-	// Reading the private key from the 'Interface' section
-	privateKey := cfg.Section("Interface").Key("PrivateKey").String()
+// RunScan returns the ranked endpoints from the cache when it is fresh, or
+// scans for new ones and caches them
+func RunScan(ctx context.Context, opts ScanOptions) ([]ScanResult, error) {
+	if opts.Network == "" {
+		opts.Network = NetworkID()
+	}
 
-	// Reading the public key from the 'Peer' section
-	publicKey := cfg.Section("Peer").Key("PublicKey").String()
+	if opts.CacheFile != "" {
+		cached, err := LoadScanCache(opts.CacheFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("unable to read scan cache: %v", err)
+		}
+		fresh := usableResults(freshResults(cached, opts.Network, opts.CacheTTL), opts.MaxRTT)
+		if len(fresh) > 0 {
+			log.Printf("using %d endpoints from %s", len(fresh), opts.CacheFile)
+			return fresh, nil
+		}
+	}
 
-	// new scanner
-	scanner := ipscanner.NewScanner(
-		ipscanner.WithWarpPing(),
-		ipscanner.WithWarpPrivateKey(privateKey),
-		ipscanner.WithWarpPeerPublicKey(publicKey),
-		ipscanner.WithUseIPv6(canConnectIPv6("[2001:4860:4860::8888]:80")),
-		ipscanner.WithUseIPv4(true),
-		ipscanner.WithMaxDesirableRTT(500),
-		ipscanner.WithCidrList([]string{
-			"162.159.192.0/24",
-			"162.159.193.0/24",
-			"162.159.195.0/24",
-			"188.114.96.0/24",
-			"188.114.97.0/24",
-			"188.114.98.0/24",
-			"188.114.99.0/24",
-			"2606:4700:d0::/48",
-			"2606:4700:d1::/48",
-		}),
-	)
-	scanner.Run()
-	timeoutTimer := time.NewTimer(2 * time.Minute)
-	defer timeoutTimer.Stop()
-
-	for {
-		select {
-		case <-(*ctx).Done():
-			// Context is done - canceled externally
-			scanner.Stop()
-			return nil, fmt.Errorf("user canceled the operation")
-		case <-timeoutTimer.C:
-			// Handle the internal timeout
-			scanner.Stop()
-			return nil, fmt.Errorf("scanner maximum time exceeded")
+	results, err := Scan(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CacheFile != "" {
+		if err := SaveScanCache(opts.CacheFile, results); err != nil {
+			log.Printf("unable to write scan cache: %v", err)
+		}
+	}
+	return usableResults(results, opts.MaxRTT), nil
+}
+
+// Scan looks for responsive IPs in opts.CIDRs and measures every combination
+// of them with the chosen ports with opts.Samples handshakes each. Every
+// measured endpoint is returned, best first.
+func Scan(ctx context.Context, opts ScanOptions) ([]ScanResult, error) {
+	if len(opts.Ports) == 0 {
+		return nil, errors.New("no ports to scan")
+	}
+	if opts.Network == "" {
+		opts.Network = NetworkID()
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	if opts.UseIPv6 && opts.ProbeIPv6 {
+		opts.UseIPv6 = canConnectIPv6(ctx, "[2001:4860:4860::8888]:80")
+	}
+
+	var history map[int]PortStat
+	if opts.CacheFile != "" {
+		cached, _ := LoadScanCache(opts.CacheFile)
+		history = PortStats(cached, opts.Network)
+	}
+	ports := choosePorts(opts.Ports, opts.PortsPerIP, history)
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("every port failed on network %s before", opts.Network)
+	}
+
+	// leave half of the time for measuring what was found
+	discoverCtx, cancelDiscover := context.WithTimeout(ctx, opts.Timeout/2)
+	ips, err := discoverIPs(discoverCtx, &opts, ports)
+	cancelDiscover()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(ips)*len(ports))
+	for _, ip := range ips {
+		for _, port := range ports {
+			endpoints = append(endpoints, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+	}
+
+	results := measureEndpoints(ctx, &opts, endpoints)
+	if ctx.Err() != nil && len(results) == 0 {
+		return nil, errors.New("scanner maximum time exceeded")
+	}
+	return results, nil
+}
+
+// PortStat counts the handshakes made on a port
+type PortStat struct {
+	Passed int
+	Failed int
+}
+
+// PortStats sums the handshakes made on every port from network
+func PortStats(results []ScanResult, network string) map[int]PortStat {
+	stats := make(map[int]PortStat)
+	for _, result := range results {
+		if result.Network != network {
+			continue
+		}
+		_, portStr, err := net.SplitHostPort(result.Endpoint)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		passed := int(math.Round(float64(result.Samples) * (1 - result.Loss)))
+		stat := stats[port]
+		stat.Passed += passed
+		stat.Failed += result.Samples - passed
+		stats[port] = stat
+	}
+	return stats
+}
+
+// choosePorts picks count ports to try, those which passed before first, then
+// untried ones at random. Ports which never passed come last, those which
+// failed the least first, so a scan which failed during an outage does not
+// leave them out for good.
+func choosePorts(ports []int, count int, history map[int]PortStat) []int {
+	var passed, untried, failed []int
+	for _, port := range ports {
+		stat, ok := history[port]
+		switch {
+		case !ok:
+			untried = append(untried, port)
+		case stat.Passed > 0:
+			passed = append(passed, port)
+		default:
+			failed = append(failed, port)
+		}
+	}
+	sort.SliceStable(passed, func(i, j int) bool {
+		a, b := history[passed[i]], history[passed[j]]
+		return a.Passed*(b.Passed+b.Failed) > b.Passed*(a.Passed+a.Failed)
+	})
+	rand.Shuffle(len(untried), func(i, j int) { untried[i], untried[j] = untried[j], untried[i] })
+	sort.SliceStable(failed, func(i, j int) bool {
+		return history[failed[i]].Failed < history[failed[j]].Failed
+	})
+
+	chosen := append(append(passed, untried...), failed...)
+	if count > 0 && len(chosen) > count {
+		chosen = chosen[:count]
+	}
+	return chosen
+}
+
+// randomAddr returns a random address in prefix
+func randomAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().AsSlice()
+	random := make([]byte, len(addr))
+	_, _ = rand.Read(random)
+	bits := prefix.Bits()
+	for i := range addr {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			mask := byte(0xff) << (8 - bits)
+			addr[i] = addr[i]&mask | random[i]&^mask
+			bits = 0
 		default:
-			ipList := scanner.GetAvailableIPS()
-			if len(ipList) > 1 {
-				scanner.Stop()
-				for i := 0; i < 2; i++ {
-					result = append(result, ipToAddress(ipList[i]))
+			addr[i] = random[i]
+		}
+	}
+	result, _ := netip.AddrFromSlice(addr)
+	return result
+}
+
+// discoverIPs probes random IPs of opts.CIDRs on one of ports until
+// opts.Candidates of them answered within opts.MaxRTT
+func discoverIPs(ctx context.Context, opts *ScanOptions, ports []int) ([]netip.Addr, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range opts.CIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if (prefix.Addr().Is4() && opts.UseIPv4) || (prefix.Addr().Is6() && opts.UseIPv6) {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no ranges to scan")
+	}
+	// stop once small ranges are exhausted
+	size := 0
+	for _, prefix := range prefixes {
+		if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits < 20 {
+			size += 1 << hostBits
+		} else {
+			size += 1 << 20
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		found []netip.Addr
+		seen  = make(map[netip.Addr]bool)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				addr := randomAddr(prefixes[rand.Intn(len(prefixes))])
+				mu.Lock()
+				tried := seen[addr]
+				seen[addr] = true
+				exhausted := len(seen) >= size
+				mu.Unlock()
+				if tried && exhausted {
+					return
+				}
+				if tried {
+					continue
+				}
+
+				endpoint := netip.AddrPortFrom(addr, uint16(ports[rand.Intn(len(ports))])).String()
+				if _, err := probeHandshake(ctx, opts, endpoint); err != nil {
+					continue
+				}
+
+				mu.Lock()
+				if len(found) < opts.Candidates {
+					found = append(found, addr)
+				}
+				if len(found) == opts.Candidates {
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(found) == 0 {
+		return nil, errors.New("no responsive IPs found")
+	}
+	return found, nil
+}
+
+// measureEndpoints makes opts.Samples handshakes with every endpoint and
+// ranks them by loss, then median handshake time
+func measureEndpoints(ctx context.Context, opts *ScanOptions, endpoints []string) []ScanResult {
+	rtts := make([][]time.Duration, len(endpoints))
+	attempts := make([]int, len(endpoints))
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				rtt, err := probeHandshake(ctx, opts, endpoints[index])
+				mu.Lock()
+				if ctx.Err() == nil {
+					attempts[index]++
+				}
+				if err == nil {
+					rtts[index] = append(rtts[index], rtt)
 				}
-				return result, nil
+				mu.Unlock()
+			}
+		}()
+	}
+
+SEND:
+	for sample := 0; sample < opts.Samples; sample++ {
+		for index := range endpoints {
+			select {
+			case jobs <- index:
+			case <-ctx.Done():
+				break SEND
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	now := time.Now()
+	results := make([]ScanResult, 0, len(endpoints))
+	for i, endpoint := range endpoints {
+		if len(rtts[i]) > attempts[i] {
+			attempts[i] = len(rtts[i])
+		}
+		if attempts[i] == 0 {
+			continue
+		}
+		result := ScanResult{
+			Network:    opts.Network,
+			Endpoint:   endpoint,
+			Loss:       1 - float64(len(rtts[i]))/float64(attempts[i]),
+			Samples:    attempts[i],
+			MeasuredAt: now,
+		}
+		if len(rtts[i]) > 0 {
+			result.RTT = float64(median(rtts[i]).Microseconds()) / 1000
+		}
+		results = append(results, result)
+	}
+	rankResults(results)
+	return results
+}
+
+// initiationPacer spaces the handshakes sent to each endpoint, as a peer
+// drops the initiations of a key which arrive too close to each other.
+// Handshakes with different endpoints go out at once.
+type initiationPacer struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// scanPacer paces the handshakes of every scan and probe of the process
+var scanPacer = &initiationPacer{next: make(map[string]time.Time)}
+
+// wait returns once a handshake may be sent to endpoint
+func (p *initiationPacer) wait(ctx context.Context, endpoint string) error {
+	p.mu.Lock()
+	now := time.Now()
+	if len(p.next) > 1024 {
+		for key, at := range p.next {
+			if at.Before(now) {
+				delete(p.next, key)
 			}
-			time.Sleep(1 * time.Second) // Prevent the loop from spinning too fast
 		}
 	}
+	at := p.next[endpoint]
+	if at.Before(now) {
+		at = now
+	}
+	p.next[endpoint] = at.Add(2 * device.HandshakeInitationRate)
+	p.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// probeHandshake measures the time it takes endpoint to answer a handshake
+// initiation, giving up after opts.MaxRTT
+func probeHandshake(ctx context.Context, opts *ScanOptions, endpoint string) (time.Duration, error) {
+	cfg := device.ProbeConfig{Endpoint: endpoint, Junk: opts.Junk}
+	if err := cfg.PrivateKey.FromHex(opts.PrivateKey); err != nil {
+		return 0, err
+	}
+	if err := cfg.PublicKey.FromHex(opts.PublicKey); err != nil {
+		return 0, err
+	}
+	if opts.PresharedKey != "" {
+		if err := cfg.PresharedKey.FromHex(opts.PresharedKey); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := scanPacer.wait(ctx, endpoint); err != nil {
+		return 0, err
+	}
+
+	// the junk packets go out before the initiation and are not timed
+	timeout := opts.MaxRTT
+	if opts.Junk {
+		timeout += 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := device.Probe(ctx, cfg)
+	if err != nil {
+		return 0, fmt.Errorf("no handshake with %s: %w", endpoint, err)
+	}
+	if result.RTT > opts.MaxRTT {
+		return 0, fmt.Errorf("handshake with %s took %v", endpoint, result.RTT)
+	}
+	return result.RTT, nil
+}
+
+func median(values []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// rankResults sorts results by loss, then median handshake time
+func rankResults(results []ScanResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Loss != results[j].Loss {
+			return results[i].Loss < results[j].Loss
+		}
+		return results[i].RTT < results[j].RTT
+	})
+}
+
+// usableResults drops the endpoints which never answered or were too slow
+func usableResults(results []ScanResult, maxRTT time.Duration) []ScanResult {
+	var usable []ScanResult
+	for _, result := range results {
+		if result.Loss < 1 && result.RTT <= float64(maxRTT.Milliseconds()) {
+			usable = append(usable, result)
+		}
+	}
+	return usable
+}
+
+// freshResults returns the endpoints which passed on network within ttl
+func freshResults(results []ScanResult, network string, ttl time.Duration) []ScanResult {
+	var fresh []ScanResult
+	for _, result := range results {
+		if result.Network == network && result.Loss < 1 && time.Since(result.MeasuredAt) < ttl {
+			fresh = append(fresh, result)
+		}
+	}
+	rankResults(fresh)
+	return fresh
 }
 
-func ipToAddress(ip net.IP) string {
-	ports := []int{500, 854, 859, 864, 878, 880, 890, 891, 894, 903, 908, 928, 934, 939, 942,
-		943, 945, 946, 955, 968, 987, 988, 1002, 1010, 1014, 1018, 1070, 1074, 1180, 1387, 1701,
-		1843, 2371, 2408, 2506, 3138, 3476, 3581, 3854, 4177, 4198, 4233, 4500, 5279,
-		5956, 7103, 7152, 7156, 7281, 7559, 8319, 8742, 8854, 8886}
+// LoadScanCache reads the results saved by SaveScanCache
+func LoadScanCache(path string) ([]ScanResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []ScanResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return results, nil
+}
+
+// SaveScanCache merges results into the cache file at path, newer
+// measurements of an endpoint on a network replacing older ones
+func SaveScanCache(path string, results []ScanResult) error {
+	cached, err := LoadScanCache(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		cached = nil
+	}
 
-	// Pick a random port number
-	b := make([]byte, 8)
-	n, err := rand.Read(b)
-	if n != 8 {
-		panic(n)
-	} else if err != nil {
-		panic(err)
+	merged := make(map[string]ScanResult, len(cached)+len(results))
+	for _, result := range append(cached, results...) {
+		key := result.Network + "/" + result.Endpoint
+		if old, ok := merged[key]; !ok || result.MeasuredAt.After(old.MeasuredAt) {
+			merged[key] = result
+		}
+	}
+	all := make([]ScanResult, 0, len(merged))
+	for _, result := range merged {
+		all = append(all, result)
 	}
-	serverAddress := fmt.Sprintf("%s:%d", ip.String(), ports[int(b[0])%len(ports)])
-	if strings.Contains(ip.String(), ":") {
-		//ip6
-		serverAddress = fmt.Sprintf("[%s]:%d", ip.String(), ports[int(b[0])%len(ports)])
+	rankResults(all)
+
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
 	}
-	return serverAddress
+	return os.WriteFile(path, data, 0644)
 }
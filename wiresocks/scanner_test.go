@@ -0,0 +1,209 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+	"github.com/bepass-org/wireguard-go/device"
+	"github.com/bepass-org/wireguard-go/tun/tuntest"
+	"golang.org/x/crypto/curve25519"
+)
+
+func genKeyPair(t *testing.T) (private, public string) {
+	var sk [32]byte
+	if _, err := rand.Read(sk[:]); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(sk[:]), hex.EncodeToString(pk)
+}
+
+// startResponder starts a device on loopback which accepts handshakes from
+// peerPublic and returns its endpoint
+func startResponder(t *testing.T, private, peerPublic string) string {
+	tun := tuntest.NewChannelTUN()
+	dev := device.NewDevice(tun.TUN(), conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+	err := dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=0\npublic_key=%s\nallowed_ip=10.0.0.1/32\n", private, peerPublic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	ipc, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(ipc, "\n") {
+		if port, ok := strings.CutPrefix(line, "listen_port="); ok {
+			return "127.0.0.1:" + port
+		}
+	}
+	t.Fatal("responder has no listen port")
+	return ""
+}
+
+func TestProbeHandshake(t *testing.T) {
+	clientPrivate, clientPublic := genKeyPair(t)
+	serverPrivate, serverPublic := genKeyPair(t)
+	endpoint := startResponder(t, serverPrivate, clientPublic)
+
+	opts := ScanOptions{PrivateKey: clientPrivate, PublicKey: serverPublic, MaxRTT: time.Second}
+	rtt, err := probeHandshake(context.Background(), &opts, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || rtt > time.Second {
+		t.Errorf("unexpected handshake time %v", rtt)
+	}
+
+	// a responder which does not know us never answers
+	_, otherPublic := genKeyPair(t)
+	opts.PublicKey = otherPublic
+	opts.MaxRTT = 100 * time.Millisecond
+	if _, err := probeHandshake(context.Background(), &opts, endpoint); err == nil {
+		t.Error("expected no handshake with the wrong peer key")
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	now := time.Now().Truncate(time.Second)
+
+	err := SaveScanCache(path, []ScanResult{
+		{Network: "home", Endpoint: "192.0.2.1:2408", RTT: 50, Samples: 2, MeasuredAt: old},
+		{Network: "home", Endpoint: "192.0.2.2:2408", RTT: 90, Samples: 2, MeasuredAt: old},
+		{Network: "work", Endpoint: "192.0.2.2:2408", RTT: 10, Samples: 2, MeasuredAt: old},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveScanCache(path, []ScanResult{
+		{Network: "home", Endpoint: "192.0.2.1:2408", RTT: 20, Loss: 1, Samples: 2, MeasuredAt: now},
+		{Network: "home", Endpoint: "192.0.2.3:2408", RTT: 70, Samples: 2, MeasuredAt: now},
+		{Network: "home", Endpoint: "192.0.2.3:500", Loss: 1, Samples: 2, MeasuredAt: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := LoadScanCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 5 {
+		t.Fatalf("expected 5 cached endpoints, got %v", cached)
+	}
+
+	fresh := freshResults(cached, "home", 10*time.Minute)
+	if len(fresh) != 1 || fresh[0].Endpoint != "192.0.2.3:2408" {
+		t.Errorf("unexpected fresh endpoints %v", fresh)
+	}
+	fresh = freshResults(cached, "home", 2*time.Hour)
+	if len(fresh) != 2 || fresh[0].Endpoint != "192.0.2.3:2408" {
+		t.Errorf("expected endpoints ranked by handshake time, got %v", fresh)
+	}
+}
+
+func TestChoosePorts(t *testing.T) {
+	results := []ScanResult{
+		{Network: "home", Endpoint: "192.0.2.1:2408", Loss: 0.5, Samples: 2},
+		{Network: "home", Endpoint: "192.0.2.2:2408", Samples: 2},
+		{Network: "home", Endpoint: "192.0.2.1:500", Samples: 3},
+		{Network: "home", Endpoint: "192.0.2.1:854", Loss: 1, Samples: 3},
+		{Network: "work", Endpoint: "192.0.2.1:859", Samples: 3},
+	}
+
+	stats := PortStats(results, "home")
+	if stats[2408] != (PortStat{Passed: 3, Failed: 1}) || stats[854] != (PortStat{Failed: 3}) {
+		t.Errorf("unexpected port stats %v", stats)
+	}
+
+	ports := choosePorts([]int{2408, 500, 854, 859, 864}, 0, stats)
+	if len(ports) != 5 || ports[0] != 500 || ports[1] != 2408 || ports[4] != 854 {
+		t.Errorf("expected passing ports first and failing ones last, got %v", ports)
+	}
+
+	if ports := choosePorts([]int{2408, 500, 854, 859, 864}, 1, stats); len(ports) != 1 || ports[0] != 500 {
+		t.Errorf("expected the best port only, got %v", ports)
+	}
+
+	// ports which all failed once are still tried, the least failed first
+	failed := map[int]PortStat{2408: {Failed: 3}, 500: {Failed: 1}, 854: {Failed: 2}}
+	if ports := choosePorts([]int{2408, 500, 854}, 2, failed); len(ports) != 2 || ports[0] != 500 || ports[1] != 854 {
+		t.Errorf("expected the least failed ports when all failed, got %v", ports)
+	}
+}
+
+func TestScanLoopback(t *testing.T) {
+	clientPrivate, clientPublic := genKeyPair(t)
+	serverPrivate, serverPublic := genKeyPair(t)
+	endpoint := startResponder(t, serverPrivate, clientPublic)
+	port, err := strconv.Atoi(endpoint[strings.LastIndex(endpoint, ":")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ScanOptions{
+		PrivateKey:  clientPrivate,
+		PublicKey:   serverPublic,
+		CIDRs:       []string{"127.0.0.1/32"},
+		Ports:       []int{port},
+		UseIPv4:     true,
+		Network:     "test",
+		Candidates:  1,
+		Concurrency: 2,
+		MaxRTT:      time.Second,
+		Samples:     3,
+		Timeout:     10 * time.Second,
+	}
+	results, err := Scan(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a loaded machine may still lose a handshake to the rate limit of the
+	// responder
+	if len(results) != 1 || results[0].Endpoint != endpoint || results[0].Loss*3 > 1.5 || results[0].Samples != 3 || results[0].RTT == 0 {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+func TestInitiationPacer(t *testing.T) {
+	pacer := &initiationPacer{next: make(map[string]time.Time)}
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := pacer.wait(ctx, "192.0.2.1:2408"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 4*device.HandshakeInitationRate {
+		t.Errorf("three handshakes with an endpoint within %v", elapsed)
+	}
+
+	// other endpoints are not held back by it
+	start = time.Now()
+	for _, endpoint := range []string{"192.0.2.2:2408", "192.0.2.3:2408", "192.0.2.1:500"} {
+		if err := pacer.wait(ctx, endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 2*device.HandshakeInitationRate {
+		t.Errorf("handshakes with distinct endpoints took %v", elapsed)
+	}
+}
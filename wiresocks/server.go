@@ -0,0 +1,450 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+	"github.com/bepass-org/wireguard-go/device"
+	"github.com/bepass-org/wireguard-go/tun/netstack"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+const (
+	// EgressDirect makes the peers of a server leave through the sockets of
+	// the host
+	EgressDirect = "direct"
+	// EgressWarp makes them leave through the primary warp tunnel
+	EgressWarp = "warp"
+
+	// egressTimeout bounds the connections and pings of the egress
+	egressTimeout = 10 * time.Second
+)
+
+// ServerConfig configures a device serving its peers, whose TCP connections,
+// UDP flows and pings end in its netstack and leave again through an egress
+type ServerConfig struct {
+	// Egress is EgressDirect, EgressWarp or the path of a config whose tunnel
+	// the peers leave through
+	Egress string
+	// MaxConnections bounds the connections, flows and pings of each peer at
+	// once, none when 0
+	MaxConnections int
+	// UDPTimeout closes the flows idle for that long
+	UDPTimeout time.Duration
+	// AllowPrivate lets the peers reach private addresses, those of the
+	// network of the host with a direct egress. Loopback and link local ones
+	// are never reached.
+	AllowPrivate bool
+}
+
+// DefaultServerConfig returns the config of a server without a [Server]
+// section
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Egress:         EgressDirect,
+		MaxConnections: 256,
+		UDPTimeout:     time.Minute,
+	}
+}
+
+// EgressDialer opens the connections of the peers of a server, network being
+// tcp, udp, ping4 or ping6, as the netstack of a tunnel does
+type EgressDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// HostEgress dials from the host. Pings go through the unprivileged ICMP
+// sockets of Linux and macOS, which net.ipv4.ping_group_range has to allow.
+func HostEgress(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "ping4" && network != "ping6" {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	listen, laddr := "udp4", "0.0.0.0"
+	if network == "ping6" {
+		listen, laddr = "udp6", "::"
+	}
+	c, err := icmp.ListenPacket(listen, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &hostPingConn{PacketConn: c, raddr: &net.UDPAddr{IP: addr.AsSlice()}}, nil
+}
+
+// hostPingConn is an ICMP socket sending to and reading from raddr only
+type hostPingConn struct {
+	*icmp.PacketConn
+	raddr *net.UDPAddr
+}
+
+func (c *hostPingConn) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(p)
+		if err != nil {
+			return 0, err
+		}
+		if udp, ok := addr.(*net.UDPAddr); ok && udp.IP.Equal(c.raddr.IP) {
+			return n, nil
+		}
+	}
+}
+
+func (c *hostPingConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.raddr)
+}
+
+func (c *hostPingConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// Server is a device whose peers reach the hosts beyond it through its
+// egress, each with addresses of its own and a bounded number of connections
+type Server struct {
+	Dev  *device.Device
+	Tnet *netstack.Net
+
+	conf    ServerConfig
+	egress  EgressDialer
+	subnets []netip.Prefix
+	peers   []*serverPeer
+	ctx     context.Context
+	verbose bool
+}
+
+// serverPeer counts the connections of a peer
+type serverPeer struct {
+	name    string
+	allowed []netip.Prefix
+
+	mu      sync.Mutex
+	conns   int
+	limited bool // whether the limit was logged since the peer was last under it
+}
+
+// StartServer starts the device of conf listening for its peers, allocating
+// an address in the subnets of [Interface] Address to those without
+// AllowedIPs, and re-originating their traffic through egress until ctx is
+// done
+func StartServer(conf *Configuration, egress EgressDialer, verbose bool, ctx context.Context) (*Server, error) {
+	dev := conf.Device
+	if dev.ListenPort == nil {
+		return nil, &ConfigError{Section: "Interface", Key: "ListenPort", Err: errors.New("a server needs a port to listen on")}
+	}
+	if err := dev.allocatePeerAddresses(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		conf:    DefaultServerConfig(),
+		egress:  egress,
+		subnets: dev.Subnets,
+		ctx:     ctx,
+		verbose: verbose,
+	}
+	if conf.Server != nil {
+		s.conf = *conf.Server
+	}
+	for _, peer := range dev.Peers {
+		name, err := encodeHexToBase64(peer.PublicKey)
+		if err != nil {
+			name = peer.PublicKey
+		}
+		s.peers = append(s.peers, &serverPeer{name: name, allowed: peer.AllowedIPs})
+		log.Printf("server: peer %s at %v", name, peer.AllowedIPs)
+	}
+
+	endpoints, err := resolvePeerEndpoints(ctx, dev)
+	if err != nil {
+		return nil, err
+	}
+	setting, err := createIPCRequest(dev, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	tun, tnet, err := netstack.CreateForwardingNetTUN(setting.deviceAddr, setting.dns, setting.mtu, dev.TCP, netstack.Forwarders{
+		TCP:  s.forwardTCP,
+		UDP:  s.forwardUDP,
+		Ping: s.forwardPing,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logLevel := device.LogLevelVerbose
+	if !verbose {
+		logLevel = device.LogLevelSilent
+	}
+	s.Dev = device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(logLevel, ""))
+	s.Tnet = tnet
+	if err := s.Dev.IpcSet(setting.ipcRequest); err != nil {
+		s.Dev.Close()
+		return nil, err
+	}
+	if err := s.Dev.Up(); err != nil {
+		s.Dev.Close()
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		s.Dev.Close()
+	}()
+	return s, nil
+}
+
+// allocatePeerAddresses gives the peers without AllowedIPs the first free
+// address of every subnet of the interface, in the order of the peers, and
+// rejects peers whose AllowedIPs overlap
+func (conf *DeviceConfig) allocatePeerAddresses() error {
+	var errs ConfigErrors
+	taken := func(addr netip.Addr) bool {
+		for _, own := range conf.Endpoint {
+			if own == addr {
+				return true
+			}
+		}
+		for _, peer := range conf.Peers {
+			for _, prefix := range peer.AllowedIPs {
+				if prefix.Contains(addr) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for i := range conf.Peers {
+		peer := &conf.Peers[i]
+		if len(peer.AllowedIPs) > 0 {
+			continue
+		}
+		for _, subnet := range conf.Subnets {
+			addr := subnet.Addr().Next() // the first address names the subnet
+			for subnet.Contains(addr) && taken(addr) {
+				addr = addr.Next()
+			}
+			if !subnet.Contains(addr) {
+				errs.add("Peer", i, "AllowedIPs", fmt.Errorf("no address left in %v", subnet))
+				continue
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		if len(peer.AllowedIPs) == 0 {
+			errs.add("Peer", i, "AllowedIPs", errors.New("no subnet in [Interface] Address to allocate an address in"))
+		}
+	}
+
+	// WireGuard would give an overlap to the last peer silently
+	for i, peer := range conf.Peers {
+		for j := 0; j < i; j++ {
+			for _, a := range peer.AllowedIPs {
+				for _, b := range conf.Peers[j].AllowedIPs {
+					if a.Overlaps(b) {
+						errs.add("Peer", i, "AllowedIPs", fmt.Errorf("%v overlaps %v of [Peer #%d]", a, b, j+1))
+					}
+				}
+			}
+		}
+	}
+
+	var located ConfigErrors
+	located.merge(errs.err(), conf.src)
+	return located.err()
+}
+
+// peer returns the peer addr belongs to, which WireGuard checked it may
+// send from
+func (s *Server) peer(addr netip.Addr) *serverPeer {
+	for _, peer := range s.peers {
+		for _, prefix := range peer.allowed {
+			if prefix.Contains(addr) {
+				return peer
+			}
+		}
+	}
+	return nil
+}
+
+// acquire takes one of the connections of the peer of remote to dst,
+// returning its release, or false when the peer may not open it
+func (s *Server) acquire(remote, dst netip.Addr) (func(), bool) {
+	peer := s.peer(remote)
+	if peer == nil || !s.allowed(dst) {
+		if s.verbose {
+			log.Printf("server: %v may not reach %v", remote, dst)
+		}
+		return nil, false
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if s.conf.MaxConnections > 0 && peer.conns >= s.conf.MaxConnections {
+		if !peer.limited {
+			log.Printf("server: peer %s reached %d connections", peer.name, peer.conns)
+			peer.limited = true
+		}
+		return nil, false
+	}
+	peer.conns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			peer.mu.Lock()
+			peer.conns--
+			if peer.conns < s.conf.MaxConnections {
+				peer.limited = false
+			}
+			peer.mu.Unlock()
+		})
+	}, true
+}
+
+// allowed reports whether the peers may reach dst, the addresses of the
+// server and its peers never being reachable through the egress
+func (s *Server) allowed(dst netip.Addr) bool {
+	dst = dst.Unmap()
+	for _, subnet := range s.subnets {
+		if subnet.Contains(dst) {
+			return false
+		}
+	}
+	if !dst.IsGlobalUnicast() {
+		return false
+	}
+	return s.conf.AllowPrivate || !dst.IsPrivate()
+}
+
+func (s *Server) forwardTCP(r *netstack.TCPForwardRequest) {
+	release, ok := s.acquire(r.Remote.Addr(), r.Local.Addr())
+	if !ok {
+		r.Reject()
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(s.ctx, egressTimeout)
+	defer cancel()
+	upstream, err := s.egress(ctx, "tcp", r.Local.String())
+	if err != nil {
+		if s.verbose {
+			log.Printf("server: unable to connect %v to %v: %v", r.Remote, r.Local, err)
+		}
+		r.Reject()
+		return
+	}
+	conn, err := r.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	forwardConn(conn, upstream)
+}
+
+func (s *Server) forwardUDP(conn *gonet.UDPConn, local, remote netip.AddrPort) {
+	defer conn.Close()
+	release, ok := s.acquire(remote.Addr(), local.Addr())
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(s.ctx, egressTimeout)
+	defer cancel()
+	upstream, err := s.egress(ctx, "udp", local.String())
+	if err != nil {
+		if s.verbose {
+			log.Printf("server: unable to connect %v to %v: %v", remote, local, err)
+		}
+		return
+	}
+	defer upstream.Close()
+
+	// either side going quiet for the timeout closes the flow
+	relay := func(dst, src net.Conn) {
+		buf := make([]byte, 64<<10)
+		for {
+			_ = src.SetReadDeadline(time.Now().Add(s.conf.UDPTimeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				break
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+		conn.Close()
+		upstream.Close()
+	}
+	go relay(upstream, conn)
+	relay(conn, upstream)
+}
+
+func (s *Server) forwardPing(r *netstack.PingForwardRequest) {
+	release, ok := s.acquire(r.Remote, r.Local)
+	if !ok {
+		return
+	}
+	defer release()
+
+	network := "ping4"
+	var request icmp.Message
+	if r.Local.Is4() {
+		request.Type = ipv4.ICMPTypeEcho
+	} else {
+		network = "ping6"
+		request.Type = ipv6.ICMPTypeEchoRequest
+	}
+	request.Body = &icmp.Echo{ID: int(r.Ident), Seq: int(r.Seq), Data: r.Data}
+	data, err := request.Marshal(nil)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, egressTimeout)
+	defer cancel()
+	upstream, err := s.egress(ctx, network, r.Local.String())
+	if err != nil {
+		if s.verbose {
+			log.Printf("server: unable to ping %v for %v: %v", r.Local, r.Remote, err)
+		}
+		return
+	}
+	defer upstream.Close()
+	_ = upstream.SetDeadline(time.Now().Add(egressTimeout))
+	if _, err := upstream.Write(data); err != nil {
+		return
+	}
+
+	// the egress may change the identifier, so the sequence matches the reply
+	proto := 1
+	if network == "ping6" {
+		proto = 58
+	}
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && reply.Type != request.Type && echo.Seq == int(r.Seq) {
+			_ = r.Reply()
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestAllocatePeerAddresses(t *testing.T) {
+	serverPrivate, _ := genKeyPair(t)
+	peer := func(allowed string) string {
+		_, key := genKeyPair(t)
+		return fmt.Sprintf("\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", base64Key(t, key), allowed)
+	}
+
+	conf, err := ParseConfigString(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.8.0.1/24, fd00:8::1/64
+ListenPort = 0
+`, base64Key(t, serverPrivate))+peer("")+peer("10.8.0.2/32")+peer(""), "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Device.allocatePeerAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	// the address of the interface and those taken by other peers are skipped
+	for i, expected := range []string{"10.8.0.3/32 fd00:8::2/128", "10.8.0.2/32", "10.8.0.4/32 fd00:8::3/128"} {
+		var allowed []string
+		for _, prefix := range conf.Device.Peers[i].AllowedIPs {
+			allowed = append(allowed, prefix.String())
+		}
+		if got := strings.Join(allowed, " "); got != expected {
+			t.Errorf("peer %d: allocated %s, expected %s", i+1, got, expected)
+		}
+	}
+
+	conf, err = ParseConfigString(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.8.0.1/30
+ListenPort = 0
+`, base64Key(t, serverPrivate))+peer("10.8.0.0/24")+peer("10.8.0.5/32")+peer(""), "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conf.Device.allocatePeerAddresses()
+	if err == nil || !strings.Contains(err.Error(), "[Peer #2]") || !strings.Contains(err.Error(), "[Peer #3]") {
+		t.Errorf("expected an overlap of peer 2 and a full subnet for peer 3, got %v", err)
+	}
+}
+
+func TestServerAllowed(t *testing.T) {
+	s := &Server{conf: DefaultServerConfig(), subnets: []netip.Prefix{netip.MustParsePrefix("10.8.0.0/24")}}
+	for addr, allowed := range map[string]bool{
+		"1.1.1.1":     true,
+		"2606:4700::": true,
+		"10.8.0.1":    false,
+		"192.168.1.1": false,
+		"127.0.0.1":   false,
+		"169.254.0.1": false,
+		"224.0.0.1":   false,
+	} {
+		if s.allowed(netip.MustParseAddr(addr)) != allowed {
+			t.Errorf("%s: allowed %v, expected %v", addr, !allowed, allowed)
+		}
+	}
+	s.conf.AllowPrivate = true
+	if !s.allowed(netip.MustParseAddr("192.168.1.1")) || s.allowed(netip.MustParseAddr("10.8.0.2")) || s.allowed(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("AllowPrivate should open private addresses but neither loopback nor the subnet of the server")
+	}
+}
+
+// testEgress answers the pings itself and dials the TCP connections to
+// target from the host
+func testEgress(target string) EgressDialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network == "tcp" {
+			return HostEgress(ctx, network, target)
+		}
+		return pingEgress(network)
+	}
+}
+
+func pingEgress(network string) (net.Conn, error) {
+	if network != "ping4" {
+		return nil, fmt.Errorf("unexpected %s egress", network)
+	}
+	conn, peer := net.Pipe()
+	go func() {
+		defer peer.Close()
+		buf := make([]byte, 1500)
+		n, err := peer.Read(buf)
+		if err != nil {
+			return
+		}
+		request, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			return
+		}
+		reply, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: request.Body}).Marshal(nil)
+		_, _ = peer.Write(reply)
+	}()
+	return conn, nil
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverPrivate, serverPublic := genKeyPair(t)
+	clientPrivate, clientPublic := genKeyPair(t)
+
+	conf, err := ParseConfigString(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.8.0.1/24
+ListenPort = 0
+
+[Peer]
+PublicKey = %s
+
+[Server]
+MaxConnections = 2
+`, base64Key(t, serverPrivate), base64Key(t, clientPublic)), "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	server, err := StartServer(conf, testEgress(listener.Addr().String()), false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipc, err := server.Dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var port string
+	for _, line := range strings.Split(ipc, "\n") {
+		if value, ok := strings.CutPrefix(line, "listen_port="); ok {
+			port = value
+		}
+	}
+
+	// the client got the first address after that of the server
+	client := startTunnel(t, ctx, fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.8.0.2/32
+
+[Peer]
+PublicKey = %s
+AllowedIPs = 0.0.0.0/0
+Endpoint = 127.0.0.1:%s
+`, base64Key(t, clientPrivate), base64Key(t, serverPublic), port), nil)
+
+	// the pings go through the egress too
+	ping, err := client.Tnet.DialContext(ctx, "ping4", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{Seq: 7, Data: []byte("ping")}}).Marshal(nil)
+	if _, err := ping.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	_ = ping.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := ping.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := icmp.ParseMessage(1, buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echo, ok := reply.Body.(*icmp.Echo); !ok || reply.Type != ipv4.ICMPTypeEchoReply || echo.Seq != 7 || string(echo.Data) != "ping" {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	ping.Close()
+
+	// the egress takes the connections to the documentation address to the
+	// echo listener
+	addr := netip.MustParseAddrPort("192.0.2.1:80")
+	dial := func() (net.Conn, error) {
+		dialCtx, dialCancel := context.WithTimeout(ctx, 30*time.Second)
+		defer dialCancel()
+		conn, err := client.Tnet.DialContextTCPAddrPort(dialCtx, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write([]byte("echo")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		buf := make([]byte, 4)
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	// the connections go through the egress, up to the limit
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	if conn, err := dial(); err == nil {
+		conn.Close()
+		t.Fatal("connection beyond the limit established")
+	}
+	conns[0].Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := dial()
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connection once one was closed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	conns[1].Close()
+}
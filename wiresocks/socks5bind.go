@@ -0,0 +1,399 @@
+package wiresocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/wireguard-go/conn"
+)
+
+const (
+	socks5DialTimeout = 10 * time.Second
+	// socks5MaxBackoff is the longest wait between two attempts to associate
+	// again after the control connection dropped
+	socks5MaxBackoff = 30 * time.Second
+)
+
+var errSocks5Closed = errors.New("socks5 bind is closed")
+
+// UpstreamConfig is a socks5 proxy or a stream relay the tunnel reaches its
+// peers through
+type UpstreamConfig struct {
+	Socks5   string // host:port of the proxy
+	Username string
+	Password string
+
+	Relay    string // tcp://, tls://, ws://, wss://, http:// or https:// URL of a relay
+	Insecure bool   // skip the verification of the TLS certificate of the relay
+}
+
+// ParseUpstream parses a socks5 proxy given as
+// [socks5://][username:password@]host:port or the URL of a relay, whose
+// certificate is not verified when the URL has an insecure query parameter
+func ParseUpstream(s string) (*UpstreamConfig, error) {
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		if scheme != "socks5" {
+			u, err := parseRelayURL(s)
+			if err != nil {
+				return nil, err
+			}
+			query := u.Query()
+			upstream := &UpstreamConfig{Insecure: query.Has("insecure")}
+			query.Del("insecure")
+			u.RawQuery = query.Encode()
+			upstream.Relay = u.String()
+			return upstream, nil
+		}
+		s = rest
+	}
+
+	upstream := &UpstreamConfig{Socks5: s}
+	if credentials, server, ok := strings.Cut(s, "@"); ok {
+		upstream.Socks5 = server
+		upstream.Username, upstream.Password, _ = strings.Cut(credentials, ":")
+	}
+	if _, _, err := net.SplitHostPort(upstream.Socks5); err != nil {
+		return nil, fmt.Errorf("invalid socks5 upstream %q: %w", s, err)
+	}
+	return upstream, nil
+}
+
+// Socks5Bind is a conn.Bind which sends the WireGuard datagrams through the
+// UDP ASSOCIATE of a socks5 proxy. The association lives as long as its
+// control connection, so a new one is made whenever that connection drops.
+type Socks5Bind struct {
+	upstream UpstreamConfig
+
+	mu    sync.Mutex
+	udp   *net.UDPConn
+	ctrl  net.Conn
+	relay netip.AddrPort
+	done  chan struct{} // closed by Close, nil while the bind is not open
+}
+
+var _ conn.Bind = (*Socks5Bind)(nil)
+
+// NewSocks5Bind returns a bind which goes through upstream
+func NewSocks5Bind(upstream UpstreamConfig) *Socks5Bind {
+	return &Socks5Bind{upstream: upstream}
+}
+
+func (b *Socks5Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl, relay, err := b.associate()
+	if err != nil {
+		_ = udp.Close()
+		return nil, 0, err
+	}
+
+	b.udp, b.ctrl, b.relay = udp, ctrl, relay
+	b.done = make(chan struct{})
+	go b.watch(ctrl, b.done)
+
+	actualPort := uint16(udp.LocalAddr().(*net.UDPAddr).Port)
+	return []conn.ReceiveFunc{b.makeReceiveFunc(udp)}, actualPort, nil
+}
+
+// associate opens a control connection to the proxy and asks it to relay
+// UDP, returning the connection and the address of the relay
+func (b *Socks5Bind) associate() (net.Conn, netip.AddrPort, error) {
+	ctrl, err := net.DialTimeout("tcp", b.upstream.Socks5, socks5DialTimeout)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	_ = ctrl.SetDeadline(time.Now().Add(socks5DialTimeout))
+	if err := socks5Handshake(ctrl, b.upstream.Username, b.upstream.Password); err != nil {
+		_ = ctrl.Close()
+		return nil, netip.AddrPort{}, err
+	}
+	relay, err := requestUDPAssociate(ctrl)
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, netip.AddrPort{}, err
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+
+	addr := relay.AddrPort()
+	if addr.Addr().IsUnspecified() {
+		// the relay is on the proxy itself
+		server := ctrl.RemoteAddr().(*net.TCPAddr).AddrPort()
+		addr = netip.AddrPortFrom(server.Addr(), addr.Port())
+	}
+	return ctrl, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), nil
+}
+
+// watch waits for the control connection to drop and associates again,
+// backing off while the proxy cannot be reached
+func (b *Socks5Bind) watch(ctrl net.Conn, done chan struct{}) {
+	_, _ = io.Copy(io.Discard, ctrl)
+
+	backoff := time.Second
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		newCtrl, relay, err := b.associate()
+		if err == nil {
+			b.mu.Lock()
+			if b.done != done {
+				// closed meanwhile
+				b.mu.Unlock()
+				_ = newCtrl.Close()
+				return
+			}
+			b.ctrl, b.relay = newCtrl, relay
+			b.mu.Unlock()
+			log.Printf("socks5 upstream %s: associated again, relay %s", b.upstream.Socks5, relay)
+			go b.watch(newCtrl, done)
+			return
+		}
+
+		log.Printf("socks5 upstream %s: unable to associate: %v", b.upstream.Socks5, err)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > socks5MaxBackoff {
+			backoff = socks5MaxBackoff
+		}
+	}
+}
+
+func (b *Socks5Bind) makeReceiveFunc(udp *net.UDPConn) conn.ReceiveFunc {
+	buf := make([]byte, 65535)
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		for {
+			n, from, err := udp.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return 0, err
+			}
+
+			b.mu.Lock()
+			relay := b.relay
+			b.mu.Unlock()
+			if netip.AddrPortFrom(from.Addr().Unmap(), from.Port()) != relay {
+				continue
+			}
+
+			src, payload, err := parseSocks5UDP(buf[:n])
+			if err != nil {
+				continue
+			}
+			sizes[0] = copy(packets[0], payload)
+			eps[0] = &conn.StdNetEndpoint{AddrPort: src}
+			return 1, nil
+		}
+	}
+}
+
+func (b *Socks5Bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done == nil {
+		return nil
+	}
+	close(b.done)
+	b.done = nil
+	err := b.udp.Close()
+	_ = b.ctrl.Close()
+	return err
+}
+
+func (b *Socks5Bind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *Socks5Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	endpoint, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	udp, relay := b.udp, b.relay
+	b.mu.Unlock()
+	if udp == nil {
+		return errSocks5Closed
+	}
+
+	header := socks5UDPHeader(endpoint.AddrPort)
+	for _, buf := range bufs {
+		packet := make([]byte, 0, len(header)+len(buf))
+		packet = append(append(packet, header...), buf...)
+		if _, err := udp.WriteToUDPAddrPort(packet, relay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Socks5Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+func (b *Socks5Bind) BatchSize() int {
+	return 1
+}
+
+// socks5UDPHeader returns the header of a datagram relayed to dst
+func socks5UDPHeader(dst netip.AddrPort) []byte {
+	addr := dst.Addr().Unmap()
+	header := []byte{0x00, 0x00, 0x00} // reserved, fragment
+	if addr.Is4() {
+		header = append(header, 0x01)
+	} else {
+		header = append(header, 0x04)
+	}
+	header = append(header, addr.AsSlice()...)
+	return binary.BigEndian.AppendUint16(header, dst.Port())
+}
+
+// parseSocks5UDP splits a relayed datagram into its source and payload
+func parseSocks5UDP(packet []byte) (netip.AddrPort, []byte, error) {
+	if len(packet) < 4 || packet[2] != 0x00 {
+		// fragments are not supported
+		return netip.AddrPort{}, nil, errors.New("invalid socks5 datagram")
+	}
+	addr, n, err := parseSocks5Addr(packet[3:])
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	return addr, packet[3+n:], nil
+}
+
+// parseSocks5Addr parses the ATYP, address and port at the start of b and
+// returns how many bytes they took. Domain names are not accepted as they
+// cannot be a WireGuard endpoint.
+func parseSocks5Addr(b []byte) (netip.AddrPort, int, error) {
+	var size int
+	switch {
+	case len(b) > 0 && b[0] == 0x01:
+		size = 4
+	case len(b) > 0 && b[0] == 0x04:
+		size = 16
+	default:
+		return netip.AddrPort{}, 0, errors.New("unsupported socks5 address type")
+	}
+	if len(b) < 1+size+2 {
+		return netip.AddrPort{}, 0, io.ErrUnexpectedEOF
+	}
+	addr, _ := netip.AddrFromSlice(b[1 : 1+size])
+	port := binary.BigEndian.Uint16(b[1+size:])
+	return netip.AddrPortFrom(addr.Unmap(), port), 1 + size + 2, nil
+}
+
+// socks5Handshake greets the proxy on conn, authenticating with username and
+// password (RFC 1929) when they are set
+func socks5Handshake(conn net.Conn, username, password string) error {
+	greeting := []byte{0x05, 0x01, 0x00} // SOCKS5, 1 authentication method, No authentication
+	if username != "" {
+		greeting = []byte{0x05, 0x02, 0x00, 0x02} // and username/password
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("invalid SOCKS5 authentication response")
+	}
+
+	switch resp[1] {
+	case 0x00:
+		return nil
+	case 0x02:
+		if username == "" {
+			return errors.New("socks5 proxy requires a username and password")
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5 username and password should be at most 255 bytes")
+		}
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errAuthFailed
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid SOCKS5 authentication response")
+	}
+}
+
+func requestUDPAssociate(conn net.Conn) (*net.UDPAddr, error) {
+	// Send UDP associate request with local address and port set to zero
+	req := []byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0} // Command: UDP Associate
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// Receive response
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if resp[1] != 0x00 {
+		return nil, fmt.Errorf("UDP ASSOCIATE request failed")
+	}
+
+	// Parse the proxy UDP address
+	var addr []byte
+	switch resp[3] {
+	case 0x01:
+		addr = make([]byte, 4+2)
+	case 0x04:
+		addr = make([]byte, 16+2)
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		addr = make([]byte, int(length[0])+2)
+	default:
+		return nil, fmt.Errorf("unsupported address type %d in UDP ASSOCIATE reply", resp[3])
+	}
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return nil, err
+	}
+	port := int(binary.BigEndian.Uint16(addr[len(addr)-2:]))
+	if resp[3] == 0x03 {
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(string(addr[:len(addr)-2]), strconv.Itoa(port)))
+	}
+	return &net.UDPAddr{IP: net.IP(addr[:len(addr)-2]), Port: port}, nil
+}
@@ -0,0 +1,172 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSocks5Proxy is a socks5 proxy which only serves UDP ASSOCIATE
+type testSocks5Proxy struct {
+	listener net.Listener
+
+	mu           sync.Mutex
+	ctrls        []net.Conn
+	associations int
+}
+
+func startSocks5Proxy(t *testing.T, username, password string) *testSocks5Proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	proxy := &testSocks5Proxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.serve(conn, username, password)
+		}
+	}()
+	return proxy
+}
+
+func (p *testSocks5Proxy) serve(conn net.Conn, username, password string) {
+	defer conn.Close()
+	ctrl, err := socks5Authenticate(conn, username, password)
+	if err != nil {
+		return
+	}
+
+	// the greeting replayed after the authentication, and the request
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, greeting); err != nil {
+		return
+	}
+	_, _ = ctrl.Write([]byte{0x05, 0x00})
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, request); err != nil || request[1] != 0x03 {
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	reply := []byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+	if _, err := ctrl.Write(reply); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.ctrls = append(p.ctrls, conn)
+	p.associations++
+	p.mu.Unlock()
+
+	go func() {
+		buf := make([]byte, 65535)
+		var client netip.AddrPort
+		for {
+			n, from, err := relay.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if !client.IsValid() || from == client {
+				// the client sends first
+				client = from
+				dst, payload, err := parseSocks5UDP(buf[:n])
+				if err == nil {
+					_, _ = relay.WriteToUDPAddrPort(payload, dst)
+				}
+				continue
+			}
+			packet := append(socks5UDPHeader(from), buf[:n]...)
+			_, _ = relay.WriteToUDPAddrPort(packet, client)
+		}
+	}()
+
+	_, _ = io.Copy(io.Discard, ctrl)
+}
+
+// dropControl closes the control connections, which ends their associations
+func (p *testSocks5Proxy) dropControl() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.ctrls {
+		conn.Close()
+	}
+	p.ctrls = nil
+}
+
+func (p *testSocks5Proxy) associationCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.associations
+}
+
+func TestParseUpstream(t *testing.T) {
+	upstream, err := ParseUpstream("user:pa:ss@127.0.0.1:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *upstream != (UpstreamConfig{Socks5: "127.0.0.1:1080", Username: "user", Password: "pa:ss"}) {
+		t.Errorf("unexpected upstream %+v", upstream)
+	}
+	if _, err := ParseUpstream("127.0.0.1"); err == nil {
+		t.Error("expected an error for a missing port")
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := startSocks5Proxy(t, "user", "pass")
+	server, config := startTunnelServer(t, ctx, "10.0.0", nil)
+	conf, err := ParseConfigString(config+`
+[Upstream]
+Socks5 = `+proxy.listener.Addr().String()+`
+Username = user
+Password = pass
+`, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := StartChain(conf, false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Dev.Close)
+
+	echoTCP(t, ctx, client, server, netip.MustParseAddrPort("10.0.0.1:80"))
+
+	// the tunnel keeps working over a new association
+	proxy.dropControl()
+	deadline := time.Now().Add(5 * time.Second)
+	for proxy.associationCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if count := proxy.associationCount(); count < 2 {
+		t.Fatalf("bind did not associate again, %d association(s)", count)
+	}
+	echoTCP(t, ctx, client, server, netip.MustParseAddrPort("10.0.0.1:81"))
+}
+
+func TestSocks5BindWrongPassword(t *testing.T) {
+	proxy := startSocks5Proxy(t, "user", "pass")
+	bind := NewSocks5Bind(UpstreamConfig{Socks5: proxy.listener.Addr().String(), Username: "user", Password: "wrong"})
+	if _, _, err := bind.Open(0); err == nil {
+		bind.Close()
+		t.Fatal("expected the association to fail")
+	}
+}
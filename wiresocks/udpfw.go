@@ -2,229 +2,293 @@ package wiresocks
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"net/netip"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 )
 
-type Socks5UDPForwarder struct {
-	socks5Server string
-	destAddr     *net.UDPAddr
-	proxyUDPAddr *net.UDPAddr
-	conn         *net.UDPConn
-	listener     *net.UDPConn
-	clientAddr   *net.UDPAddr
+// udpSessionTimeout is how long a client may stay silent before its session
+// is closed
+const udpSessionTimeout = 2 * time.Minute
+
+// VtunUDPForwarder forwards the datagrams received on a local address to a
+// destination through the tunnel. Every client address gets a session with a
+// tunnel socket of its own, so replies reach the client that sent the request.
+type VtunUDPForwarder struct {
+	listener    *net.UDPConn
+	dest        netip.AddrPort
+	vtun        *VirtualTun
+	mtu         int
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*udpSession // nil once closed
+	wg       sync.WaitGroup
+	done     chan struct{}
+	once     sync.Once
+
+	totalSessions      atomic.Uint64
+	rxPackets, rxBytes atomic.Uint64
+	txPackets, txBytes atomic.Uint64
+	dropped            atomic.Uint64
+}
+
+// UDPForwarderStats counts the traffic of a VtunUDPForwarder. Tx is from the
+// clients to the destination and Rx the replies.
+type UDPForwarderStats struct {
+	Sessions      int
+	TotalSessions uint64
+	TxPackets     uint64
+	TxBytes       uint64
+	RxPackets     uint64
+	RxBytes       uint64
+	Dropped       uint64
+}
+
+type udpSession struct {
+	client   netip.AddrPort
+	conn     *gonet.UDPConn
+	lastSeen atomic.Int64 // unix nanoseconds
 }
 
-func NewVtunUDPForwarder(localBind, dest string, vtun *VirtualTun, mtu int, ctx context.Context) error {
+// NewVtunUDPForwarder listens on localBind and forwards to dest through vtun
+// until ctx is done or Close is called
+func NewVtunUDPForwarder(localBind, dest string, vtun *VirtualTun, mtu int, ctx context.Context) (*VtunUDPForwarder, error) {
+	return newVtunUDPForwarder(localBind, dest, vtun, mtu, udpSessionTimeout, ctx)
+}
+
+func newVtunUDPForwarder(localBind, dest string, vtun *VirtualTun, mtu int, idleTimeout time.Duration, ctx context.Context) (*VtunUDPForwarder, error) {
 	localAddr, err := net.ResolveUDPAddr("udp", localBind)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	destAddr, err := net.ResolveUDPAddr("udp", dest)
+	destAddr, err := resolveThroughTunnel(ctx, vtun, dest)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	listener, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rconn, err := vtun.Tnet.DialUDP(nil, destAddr)
-	if err != nil {
-		return err
+	f := &VtunUDPForwarder{
+		listener:    listener,
+		dest:        destAddr,
+		vtun:        vtun,
+		mtu:         mtu,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[netip.AddrPort]*udpSession),
+		done:        make(chan struct{}),
 	}
 
-	var clientAddr *net.UDPAddr
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		buffer := make([]byte, mtu)
-		for {
-			select {
-			case <-ctx.Done():
-				wg.Done()
-				return
-			default:
-				n, cAddr, err := listener.ReadFrom(buffer)
-				if err != nil {
-					continue
-				}
-
-				clientAddr = cAddr.(*net.UDPAddr)
-
-				rconn.WriteTo(buffer[:n], destAddr)
-			}
-		}
-	}()
+	f.wg.Add(2)
+	go f.serve()
+	go f.expireSessions()
 	go func() {
-		buffer := make([]byte, mtu)
-		for {
-			select {
-			case <-ctx.Done():
-				wg.Done()
-				return
-			default:
-				n, _, err := rconn.ReadFrom(buffer)
-				if err != nil {
-					continue
-				}
-				if clientAddr != nil {
-					listener.WriteTo(buffer[:n], clientAddr)
-				}
-			}
+		select {
+		case <-ctx.Done():
+			f.Close()
+		case <-f.done:
 		}
 	}()
-	go func() {
-		wg.Wait()
-		_ = listener.Close()
-		_ = rconn.Close()
-	}()
-	return nil
+	return f, nil
 }
 
-func NewSocks5UDPForwarder(localBind, socks5Server, dest string) (*Socks5UDPForwarder, error) {
-	localAddr, err := net.ResolveUDPAddr("udp", localBind)
+// resolveThroughTunnel resolves the host of dest with the DNS servers of
+// vtun, as a dial through the tunnel would
+func resolveThroughTunnel(ctx context.Context, vtun *VirtualTun, dest string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(dest)
 	if err != nil {
-		return nil, err
+		return netip.AddrPort{}, err
 	}
-
-	destAddr, err := net.ResolveUDPAddr("udp", dest)
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		return nil, err
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", portStr)
 	}
-
-	listener, err := net.ListenUDP("udp", localAddr)
-	if err != nil {
-		return nil, err
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
 	}
-
-	tcpConn, err := net.Dial("tcp", socks5Server)
+	hosts, err := vtun.Tnet.LookupContextHost(ctx, host)
 	if err != nil {
-		return nil, err
-	}
-	defer tcpConn.Close()
-
-	if err := socks5Handshake(tcpConn); err != nil {
-		return nil, err
+		return netip.AddrPort{}, err
 	}
-
-	proxyUDPAddr, err := requestUDPAssociate(tcpConn)
+	addr, err := netip.ParseAddr(hosts[0])
 	if err != nil {
-		return nil, err
+		return netip.AddrPort{}, err
 	}
-
-	udpConn, err := net.DialUDP("udp", nil, proxyUDPAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Socks5UDPForwarder{
-		socks5Server: socks5Server,
-		destAddr:     destAddr,
-		proxyUDPAddr: proxyUDPAddr,
-		conn:         udpConn,
-		listener:     listener,
-	}, nil
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
 }
 
-func (f *Socks5UDPForwarder) Start() {
-	go f.listenAndServe()
-	go f.receiveFromProxy()
+// LocalAddr returns the address the forwarder listens on
+func (f *VtunUDPForwarder) LocalAddr() net.Addr {
+	return f.listener.LocalAddr()
 }
 
-func socks5Handshake(conn net.Conn) error {
-	// Send greeting
-	_, err := conn.Write([]byte{0x05, 0x01, 0x00}) // SOCKS5, 1 authentication method, No authentication
-	if err != nil {
-		return err
-	}
+// Close stops the forwarder and closes every session
+func (f *VtunUDPForwarder) Close() error {
+	var err error
+	f.once.Do(func() {
+		close(f.done)
+		err = f.listener.Close()
 
-	// Receive server response
-	resp := make([]byte, 2)
-	if _, err := io.ReadFull(conn, resp); err != nil {
-		return err
-	}
+		f.mu.Lock()
+		for _, session := range f.sessions {
+			_ = session.conn.Close()
+		}
+		f.sessions = nil
+		f.mu.Unlock()
+	})
+	return err
+}
+
+// Wait blocks until the forwarder is closed and all its goroutines are done
+func (f *VtunUDPForwarder) Wait() {
+	f.wg.Wait()
+}
 
-	if resp[0] != 0x05 || resp[1] != 0x00 {
-		return fmt.Errorf("invalid SOCKS5 authentication response")
+// Stats returns the counters of the forwarder
+func (f *VtunUDPForwarder) Stats() UDPForwarderStats {
+	f.mu.Lock()
+	sessions := len(f.sessions)
+	f.mu.Unlock()
+	return UDPForwarderStats{
+		Sessions:      sessions,
+		TotalSessions: f.totalSessions.Load(),
+		TxPackets:     f.txPackets.Load(),
+		TxBytes:       f.txBytes.Load(),
+		RxPackets:     f.rxPackets.Load(),
+		RxBytes:       f.rxBytes.Load(),
+		Dropped:       f.dropped.Load(),
 	}
-	return nil
 }
 
-func (f *Socks5UDPForwarder) listenAndServe() {
+// serve reads the datagrams of the clients and sends them on their session
+func (f *VtunUDPForwarder) serve() {
+	defer f.wg.Done()
+	buffer := make([]byte, f.mtu)
 	for {
-		buffer := make([]byte, 4096)
-		// Listen for incoming UDP packets
-		n, clientAddr, err := f.listener.ReadFromUDP(buffer)
+		n, client, err := f.listener.ReadFromUDPAddrPort(buffer)
 		if err != nil {
-			fmt.Printf("Error reading from listener: %v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.vtun.Logger.Debug("udp forwarder: read failed:", err)
 			continue
 		}
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
 
-		// Store client address for response mapping
-		f.clientAddr = clientAddr
-
-		// Forward packet to destination via SOCKS5 proxy
-		go f.forwardPacketToRemote(buffer[:n])
+		session, err := f.session(client)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.dropped.Add(1)
+			f.vtun.Logger.Debug("udp forwarder: unable to open session for", client, err)
+			continue
+		}
+		session.lastSeen.Store(time.Now().UnixNano())
+		if _, err := session.conn.Write(buffer[:n]); err != nil {
+			f.dropped.Add(1)
+			f.closeSession(session)
+			continue
+		}
+		f.txPackets.Add(1)
+		f.txBytes.Add(uint64(n))
 	}
 }
 
-func (f *Socks5UDPForwarder) forwardPacketToRemote(data []byte) {
-	packet := make([]byte, 10+len(data))
-	packet[0] = 0x00 // Reserved
-	packet[1] = 0x00 // Reserved
-	packet[2] = 0x00 // Fragment
-	packet[3] = 0x01 // Address type (IPv4)
-	copy(packet[4:8], f.destAddr.IP.To4())
-	binary.BigEndian.PutUint16(packet[8:10], uint16(f.destAddr.Port))
-	copy(packet[10:], data)
-
-	_, err := f.conn.Write(packet)
+// session returns the session of client, opening it on first use
+func (f *VtunUDPForwarder) session(client netip.AddrPort) (*udpSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions == nil {
+		return nil, net.ErrClosed
+	}
+	if session, ok := f.sessions[client]; ok {
+		return session, nil
+	}
+
+	conn, err := f.vtun.Tnet.DialUDPAddrPort(netip.AddrPort{}, f.dest)
 	if err != nil {
-		fmt.Printf("Error forwarding packet to remote: %v\n", err)
+		return nil, err
 	}
+	session := &udpSession{client: client, conn: conn}
+	session.lastSeen.Store(time.Now().UnixNano())
+	f.sessions[client] = session
+	f.totalSessions.Add(1)
+
+	f.wg.Add(1)
+	go f.reply(session)
+	return session, nil
 }
 
-func (f *Socks5UDPForwarder) receiveFromProxy() {
+// reply sends the datagrams received on the session back to its client
+func (f *VtunUDPForwarder) reply(session *udpSession) {
+	defer f.wg.Done()
+	defer f.closeSession(session)
+	buffer := make([]byte, f.mtu)
 	for {
-		buffer := make([]byte, 4096)
-		n, err := f.conn.Read(buffer)
+		n, err := session.conn.Read(buffer)
 		if err != nil {
-			fmt.Printf("Error reading from proxy connection: %v\n", err)
+			return
+		}
+		session.lastSeen.Store(time.Now().UnixNano())
+		if _, err := f.listener.WriteToUDPAddrPort(buffer[:n], session.client); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.dropped.Add(1)
 			continue
 		}
-
-		// Forward the packet to the original client
-		f.listener.WriteToUDP(buffer[10:n], f.clientAddr)
+		f.rxPackets.Add(1)
+		f.rxBytes.Add(uint64(n))
 	}
 }
 
-func requestUDPAssociate(conn net.Conn) (*net.UDPAddr, error) {
-	// Send UDP associate request with local address and port set to zero
-	req := []byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0} // Command: UDP Associate
-	if _, err := conn.Write(req); err != nil {
-		return nil, err
+// closeSession closes session and forgets it, a new datagram from its client
+// opens a new one
+func (f *VtunUDPForwarder) closeSession(session *udpSession) {
+	f.mu.Lock()
+	if f.sessions[session.client] == session {
+		delete(f.sessions, session.client)
 	}
+	f.mu.Unlock()
+	_ = session.conn.Close()
+}
 
-	// Receive response
-	resp := make([]byte, 10)
-	if _, err := io.ReadFull(conn, resp); err != nil {
-		return nil, err
-	}
+// expireSessions closes the sessions idle for longer than idleTimeout
+func (f *VtunUDPForwarder) expireSessions() {
+	defer f.wg.Done()
+	ticker := time.NewTicker(f.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
 
-	if resp[1] != 0x00 {
-		return nil, fmt.Errorf("UDP ASSOCIATE request failed")
+		deadline := time.Now().Add(-f.idleTimeout).UnixNano()
+		var idle []*udpSession
+		f.mu.Lock()
+		for _, session := range f.sessions {
+			if session.lastSeen.Load() < deadline {
+				idle = append(idle, session)
+			}
+		}
+		f.mu.Unlock()
+		for _, session := range idle {
+			f.vtun.Logger.Debug("udp forwarder: session of", session.client, "expired")
+			f.closeSession(session)
+		}
 	}
-
-	// Parse the proxy UDP address
-	bindIP := net.IP(resp[4:8])
-	bindPort := binary.BigEndian.Uint16(resp[8:10])
-
-	return &net.UDPAddr{IP: bindIP, Port: int(bindPort)}, nil
 }
@@ -0,0 +1,98 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVtunUDPForwarder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, server := startTunnelPair(t, ctx, "10.0.0", nil, nil)
+
+	// echo every datagram back, prefixed with the address it came from
+	echo, err := server.Tnet.ListenUDPAddrPort(netip.MustParseAddrPort("10.0.0.1:7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(append([]byte(addr.String()+" "), buf[:n]...), addr)
+		}
+	}()
+
+	forwarder, err := newVtunUDPForwarder("127.0.0.1:0", "10.0.0.1:7", client, 1500, 500*time.Millisecond, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every client gets its own tunnel socket and only its own replies
+	sources := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("udp", forwarder.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		message := fmt.Sprintf("client %d", i)
+		var reply string
+		buf := make([]byte, 1500)
+		// the first datagrams may be lost while the handshake completes
+		for attempt := 0; attempt < 20 && reply == ""; attempt++ {
+			if _, err := conn.Write([]byte(message)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			if n, err := conn.Read(buf); err == nil {
+				reply = string(buf[:n])
+			}
+		}
+		source, echoed, _ := strings.Cut(reply, " ")
+		if echoed != message {
+			t.Fatalf("client %d got %q", i, reply)
+		}
+		sources[source] = true
+	}
+	if len(sources) != 3 {
+		t.Errorf("clients shared tunnel sockets: %v", sources)
+	}
+
+	stats := forwarder.Stats()
+	if stats.TotalSessions < 3 || stats.RxPackets < 3 || stats.TxPackets < stats.RxPackets {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// idle sessions expire
+	deadline := time.Now().Add(5 * time.Second)
+	for forwarder.Stats().Sessions != 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if sessions := forwarder.Stats().Sessions; sessions != 0 {
+		t.Errorf("%d sessions did not expire", sessions)
+	}
+
+	// the forwarder shuts down with the context
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		forwarder.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarder did not stop with the context")
+	}
+}
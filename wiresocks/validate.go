@@ -0,0 +1,205 @@
+package wiresocks
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ConfigError describes a problem found in a section of a config file
+type ConfigError struct {
+	File    string // empty for the main config file
+	Line    int    // zero when unknown
+	Section string
+	Index   int    // occurrence of the section, for sections like [Peer] that may repeat
+	Key     string // empty when the problem is with the section itself
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		b.WriteString(fmt.Sprintf("line %d: ", e.Line))
+	} else if e.File != "" {
+		b.WriteString(" ")
+	}
+	if e.Index > 0 || strings.EqualFold(e.Section, "Peer") {
+		b.WriteString(fmt.Sprintf("[%s #%d]", e.Section, e.Index+1))
+	} else {
+		b.WriteString(fmt.Sprintf("[%s]", e.Section))
+	}
+	if e.Key != "" {
+		b.WriteString(" ")
+		b.WriteString(e.Key)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors is a list of every problem found in a config file
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs *ConfigErrors) add(section string, index int, key string, err error) {
+	*errs = append(*errs, &ConfigError{Section: section, Index: index, Key: key, Err: err})
+}
+
+// merge appends the problems in err to errs and locates them in src
+func (errs *ConfigErrors) merge(err error, src *sourceIndex) {
+	if err == nil {
+		return
+	}
+	var list ConfigErrors
+	var single *ConfigError
+	switch {
+	case errors.As(err, &list):
+	case errors.As(err, &single):
+		list = ConfigErrors{single}
+	default:
+		list = ConfigErrors{{Err: err}}
+	}
+	for _, e := range list {
+		if src != nil && e.Line == 0 && e.File == "" {
+			e.File = src.file
+			e.Line = src.line(e.Section, e.Index, e.Key)
+		}
+		*errs = append(*errs, e)
+	}
+}
+
+func (errs ConfigErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// sourceIndex remembers the line of every section and key of an ini file,
+// as go-ini does not keep track of them
+type sourceIndex struct {
+	file  string
+	lines map[string]int
+}
+
+func sourceKey(section string, index int, key string) string {
+	return fmt.Sprintf("%s/%d/%s", strings.ToLower(section), index, strings.ToLower(key))
+}
+
+func newSourceIndex(file string, data []byte) *sourceIndex {
+	src := &sourceIndex{file: file, lines: make(map[string]int)}
+	counts := make(map[string]int)
+	section, index := "", 0
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			index = counts[section]
+			counts[section]++
+			src.lines[sourceKey(section, index, "")] = i + 1
+			continue
+		}
+		if key, _, ok := strings.Cut(line, "="); ok {
+			k := sourceKey(section, index, strings.TrimSpace(key))
+			if _, exists := src.lines[k]; !exists {
+				src.lines[k] = i + 1
+			}
+		}
+	}
+	return src
+}
+
+// line returns the line of key in the index-th section, falling back to the
+// line of the section header when the key is missing
+func (src *sourceIndex) line(section string, index int, key string) int {
+	if line, ok := src.lines[sourceKey(section, index, key)]; ok {
+		return line
+	}
+	return src.lines[sourceKey(section, index, "")]
+}
+
+func isHexKey(key string) bool {
+	decoded, err := hex.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+// Validate reports every problem in the device configuration that would stop
+// the tunnel from working, each with the section and line it comes from
+func (conf *DeviceConfig) Validate() error {
+	var errs ConfigErrors
+
+	if !isHexKey(conf.SecretKey) {
+		errs.add("Interface", 0, "PrivateKey", errors.New("a 32 byte base64 private key is required"))
+	}
+	if len(conf.Endpoint) == 0 {
+		errs.add("Interface", 0, "Address", errors.New("at least one address is required"))
+	}
+	for _, addr := range conf.Endpoint {
+		if !addr.IsValid() {
+			errs.add("Interface", 0, "Address", fmt.Errorf("invalid address %v", addr))
+		}
+	}
+	if conf.MTU < 576 || conf.MTU > 65535 {
+		errs.add("Interface", 0, "MTU", fmt.Errorf("%d is out of range [576, 65535]", conf.MTU))
+	}
+	if conf.ListenPort != nil && (*conf.ListenPort < 0 || *conf.ListenPort > 65535) {
+		errs.add("Interface", 0, "ListenPort", fmt.Errorf("%d is out of range [0, 65535]", *conf.ListenPort))
+	}
+
+	if len(conf.Peers) == 0 {
+		errs.add("Peer", 0, "", errors.New("at least one [Peer] is expected"))
+	}
+	seen := make(map[string]int)
+	for i, peer := range conf.Peers {
+		if !isHexKey(peer.PublicKey) {
+			errs.add("Peer", i, "PublicKey", errors.New("a 32 byte base64 public key is required"))
+		} else if first, ok := seen[peer.PublicKey]; ok {
+			errs.add("Peer", i, "PublicKey", fmt.Errorf("duplicate of [Peer #%d]", first+1))
+		} else {
+			seen[peer.PublicKey] = i
+		}
+		if peer.PreSharedKey != "" && !isHexKey(peer.PreSharedKey) {
+			errs.add("Peer", i, "PreSharedKey", errors.New("preshared key should be 32 bytes"))
+		}
+		if peer.Endpoint != nil {
+			if _, port, err := net.SplitHostPort(*peer.Endpoint); err != nil {
+				errs.add("Peer", i, "Endpoint", err)
+			} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				errs.add("Peer", i, "Endpoint", fmt.Errorf("invalid port %q", port))
+			}
+		}
+		if peer.KeepAlive < 0 || peer.KeepAlive > 65535 {
+			errs.add("Peer", i, "PersistentKeepalive", fmt.Errorf("%d is out of range [0, 65535]", peer.KeepAlive))
+		}
+		for _, prefix := range peer.AllowedIPs {
+			if prefix != prefix.Masked() {
+				errs.add("Peer", i, "AllowedIPs", fmt.Errorf("%v has host bits set, did you mean %v?", prefix, prefix.Masked()))
+			}
+		}
+	}
+
+	var located ConfigErrors
+	located.merge(errs.err(), conf.src)
+	return located.err()
+}
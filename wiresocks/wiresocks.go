@@ -21,8 +21,9 @@ type DeviceSetting struct {
 	mtu        int
 }
 
-// serialize the config into an IPC request and DeviceSetting
-func createIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
+// serialize the config into an IPC request and DeviceSetting, using the
+// resolved peer endpoints
+func createIPCRequest(conf *DeviceConfig, endpoints map[string]string) (*DeviceSetting, error) {
 	var request bytes.Buffer
 
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.SecretKey))
@@ -31,7 +32,8 @@ func createIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
 		request.WriteString(fmt.Sprintf("listen_port=%d\n", *conf.ListenPort))
 	}
 
-	for _, peer := range conf.Peers {
+	for i := range conf.Peers {
+		peer := &conf.Peers[i]
 		request.WriteString(fmt.Sprintf(heredoc.Doc(`
 				public_key=%s
 				persistent_keepalive_interval=%d
@@ -40,7 +42,7 @@ func createIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
 			peer.PublicKey, peer.KeepAlive, peer.PreSharedKey,
 		))
 		if peer.Endpoint != nil {
-			request.WriteString(fmt.Sprintf("endpoint=%s\n", *peer.Endpoint))
+			request.WriteString(fmt.Sprintf("endpoint=%s\n", deviceEndpoint(peer, endpoints)))
 		}
 
 		if len(peer.AllowedIPs) > 0 {
@@ -61,40 +63,125 @@ func createIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
 
 // StartWireguard creates a tun interface on netstack given a configuration
 func StartWireguard(conf *DeviceConfig, verbose bool, ctx context.Context) (*VirtualTun, error) {
-	setting, err := createIPCRequest(conf)
+	return startWireguard(conf, nil, nil, verbose, ctx)
+}
+
+// StartNestedWireguard creates a tun interface on netstack whose packets are
+// sent through the outer tunnel instead of a socket of the host. The MTU is
+// lowered to what fits in a packet of the outer tunnel.
+func StartNestedWireguard(conf *DeviceConfig, outer *VirtualTun, verbose bool, ctx context.Context) (*VirtualTun, error) {
+	return startWireguard(conf, outer, nil, verbose, ctx)
+}
+
+// StartChain starts every hop of conf, each carried by the previous one, and
+// then the device of conf through the last hop. The first of them goes
+// through conf.Upstream when it is set.
+func StartChain(conf *Configuration, verbose bool, ctx context.Context) (*VirtualTun, error) {
+	upstream := conf.Upstream
+	var outer *VirtualTun
+	var hops []*VirtualTun
+	// the hops started are closed when a later one fails
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Dev.Close()
+		}
+	}
+	for i, hop := range conf.Hops {
+		vt, err := startWireguard(hop, outer, upstream, verbose, ctx)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("hop %d: %w", i+1, err)
+		}
+		hops = append(hops, vt)
+		outer, upstream = vt, nil
+	}
+	vt, err := startWireguard(conf.Device, outer, upstream, verbose, ctx)
 	if err != nil {
+		closeHops()
 		return nil, err
 	}
+	return vt, nil
+}
 
-	tun, tnet, err := netstack.CreateNetTUN(setting.deviceAddr, setting.dns, setting.mtu)
+func startWireguard(conf *DeviceConfig, outer *VirtualTun, upstream *UpstreamConfig, verbose bool, ctx context.Context) (*VirtualTun, error) {
+	endpoints, err := resolvePeerEndpoints(ctx, conf)
 	if err != nil {
 		return nil, err
 	}
 
+	setting, err := createIPCRequest(conf, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	var bind conn.Bind
+	switch {
+	case outer == nil && upstream != nil && upstream.Relay != "":
+		bind, err = newUpstreamRelayBind(upstream)
+		if err != nil {
+			return nil, err
+		}
+	case outer == nil && upstream != nil:
+		bind = NewSocks5Bind(*upstream)
+	case outer == nil:
+		bind = conn.NewDefaultBind()
+	default:
+		bind = netstack.NewBind(outer.Tnet)
+		if mtu := nestedMTU(outer, endpoints); setting.mtu > mtu {
+			setting.mtu = mtu
+		}
+	}
+
+	tun, tnet, err := netstack.CreateNetTUNWithOptions(setting.deviceAddr, setting.dns, setting.mtu, conf.TCP)
+	if err != nil {
+		_ = bind.Close()
+		return nil, err
+	}
+
 	logLevel := device.LogLevelVerbose
 	if !verbose {
 		logLevel = device.LogLevelSilent
 	}
 
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(logLevel, ""))
+	// the device closes the tun and the bind with it
+	dev := device.NewDevice(tun, bind, device.NewLogger(logLevel, ""))
 	err = dev.IpcSet(setting.ipcRequest)
 	if err != nil {
+		dev.Close()
 		return nil, err
 	}
 
 	err = dev.Up()
 	if err != nil {
+		dev.Close()
 		return nil, err
 	}
 
-	return &VirtualTun{
+	vt := &VirtualTun{
 		Tnet:      tnet,
 		SystemDNS: len(setting.dns) == 0,
 		Verbose:   verbose,
 		Logger: DefaultLogger{
 			verbose: verbose,
 		},
-		Dev: dev,
-		Ctx: ctx,
-	}, nil
+		Dev:       dev,
+		Ctx:       ctx,
+		conf:      conf,
+		endpoints: endpoints,
+	}
+	go vt.watchEndpoints()
+
+	return vt, nil
+}
+
+// nestedMTU returns the largest MTU of a tunnel to endpoints whose packets,
+// with their IP, UDP and WireGuard headers, fit in a packet of outer
+func nestedMTU(outer *VirtualTun, endpoints map[string]string) int {
+	overhead := 20 + 8 + device.MessageTransportSize
+	for _, endpoint := range endpoints {
+		if addrPort, err := netip.ParseAddrPort(endpoint); err == nil && addrPort.Addr().Unmap().Is6() {
+			overhead = 40 + 8 + device.MessageTransportSize
+		}
+	}
+	return outer.Tnet.MTU() - overhead
 }
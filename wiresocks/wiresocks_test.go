@@ -0,0 +1,233 @@
+package wiresocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func base64Key(t *testing.T, key string) string {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// startTunnel starts the tunnel of config, through outer when it is set
+func startTunnel(t *testing.T, ctx context.Context, config string, outer *VirtualTun) *VirtualTun {
+	conf, err := ParseConfigString(config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt, err := StartNestedWireguard(conf.Device, outer, false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vt.Dev.Close)
+	return vt
+}
+
+// startTunnelServer starts a tunnel at net.1 which accepts a client at net.2
+// over loopback, or through outer when it is set, and returns the config of
+// that client
+func startTunnelServer(t *testing.T, ctx context.Context, net string, outer *VirtualTun) (*VirtualTun, string) {
+	clientPrivate, clientPublic := genKeyPair(t)
+	serverPrivate, serverPublic := genKeyPair(t)
+
+	server := startTunnel(t, ctx, fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s.1/32
+ListenPort = 0
+
+[Peer]
+PublicKey = %s
+AllowedIPs = %s.2/32
+`, base64Key(t, serverPrivate), net, base64Key(t, clientPublic), net), outer)
+
+	ipc, err := server.Dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var port string
+	for _, line := range strings.Split(ipc, "\n") {
+		if value, ok := strings.CutPrefix(line, "listen_port="); ok {
+			port = value
+		}
+	}
+	host := "127.0.0.1"
+	if outer != nil {
+		host = outer.conf.Endpoint[0].String()
+	}
+
+	return server, fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s.2/32
+
+[Peer]
+PublicKey = %s
+AllowedIPs = %s.1/32
+Endpoint = %s:%s
+`, base64Key(t, clientPrivate), net, base64Key(t, serverPublic), net, host, port)
+}
+
+// startTunnelPair connects two netstack tunnels, the client at net.2 and the
+// server at net.1. Their packets go over loopback, or through the outer
+// tunnels when these are set.
+func startTunnelPair(t *testing.T, ctx context.Context, net string, clientOuter, serverOuter *VirtualTun) (client, server *VirtualTun) {
+	server, config := startTunnelServer(t, ctx, net, serverOuter)
+	return startTunnel(t, ctx, config, clientOuter), server
+}
+
+// echoTCP checks that a payload sent from client to the echo server at addr
+// comes back unchanged
+func echoTCP(t *testing.T, ctx context.Context, client, server *VirtualTun, addr netip.AddrPort) {
+	listener, err := server.Tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 30*time.Second)
+	defer dialCancel()
+	conn, err := client.Tnet.DialContextTCPAddrPort(dialCtx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// larger than the MTU so full sized packets cross every tunnel
+	payload := make([]byte, 64<<10)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Error("payload was corrupted through the tunnels")
+	}
+}
+
+func TestNestedWireguard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outerClient, outerServer := startTunnelPair(t, ctx, "10.0.0", nil, nil)
+	client, server := startTunnelPair(t, ctx, "10.1.0", outerClient, outerServer)
+
+	if mtu, expected := client.Tnet.MTU(), outerClient.Tnet.MTU()-60; mtu != expected {
+		t.Errorf("nested MTU is %d, expected %d", mtu, expected)
+	}
+	echoTCP(t, ctx, client, server, netip.MustParseAddrPort("10.1.0.1:80"))
+}
+
+func TestStartChain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// three servers, each reached through the previous one
+	dir := t.TempDir()
+	var chain strings.Builder
+	var outer, server *VirtualTun
+	for i := 0; i < 3; i++ {
+		var config string
+		server, config = startTunnelServer(t, ctx, fmt.Sprintf("10.%d.0", i), outer)
+		outer = server
+		if i == 2 {
+			chain.WriteString(config)
+			break
+		}
+
+		// the hop config has a stale endpoint, the [Hop] section fixes it
+		endpoint := config[strings.Index(config, "Endpoint = ")+len("Endpoint = "):]
+		endpoint = strings.TrimSpace(endpoint)
+		path := filepath.Join(dir, fmt.Sprintf("hop%d.conf", i))
+		stale := strings.Replace(config, endpoint, "192.0.2.1:51820", 1)
+		if err := os.WriteFile(path, []byte(stale), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&chain, "[Hop]\nWGConfig = %s\nEndpoint = %s\nMTU = 1400\nPersistentKeepalive = 25\n\n", path, endpoint)
+	}
+
+	conf, err := ParseConfigString(chain.String(), "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Hops) != 2 || conf.Hops[0].MTU != 1400 || conf.Hops[1].Peers[0].KeepAlive != 25 {
+		t.Fatalf("unexpected hops %+v", conf.Hops)
+	}
+
+	client, err := StartChain(conf, false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Dev.Close)
+
+	// 1400 for the first hop, 1340 for the second and 1280 for the last
+	if mtu := client.Tnet.MTU(); mtu != 1280 {
+		t.Errorf("MTU of the last tunnel is %d, expected 1280", mtu)
+	}
+	echoTCP(t, ctx, client, server, netip.MustParseAddrPort("10.2.0.1:80"))
+}
+
+func TestStartChainFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hopServer, hopConfig := startTunnelServer(t, ctx, "10.0.0", nil)
+	_, config := startTunnelServer(t, ctx, "10.1.0", hopServer)
+	path := filepath.Join(t.TempDir(), "hop.conf")
+	if err := os.WriteFile(path, []byte(hopConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ParseConfigString(fmt.Sprintf("[Hop]\nWGConfig = %s\n\n", path)+config, "notset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hop listens on a known port, and the last tunnel cannot resolve
+	// its endpoint
+	_, portStr, _ := net.SplitHostPort(freeAddr(t, "udp"))
+	port, _ := strconv.Atoi(portStr)
+	conf.Hops[0].ListenPort = &port
+	endpoint := "wg.test:51820"
+	conf.Device.Peers[0].Endpoint = &endpoint
+	conf.Device.Resolver = ResolverOptions{DoH: startDoHServer(t).URL}
+
+	if client, err := StartChain(conf, false, ctx); err == nil {
+		client.Dev.Close()
+		t.Fatal("chain started without resolving its last endpoint")
+	}
+
+	// the socket of the hop was closed with it
+	conn, err := net.ListenPacket("udp", ":"+portStr)
+	if err != nil {
+		t.Fatalf("hop still holds its port: %v", err)
+	}
+	conn.Close()
+}